@@ -0,0 +1,203 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+// Package config reads the settings of wwsconnector and wwscat from a YAML
+// file. The file's keys are the command line flags' long names:
+//
+//	listen: ":8080"
+//	create-rate: 10
+//	ban-time: 1h
+//	cors:
+//	  - https://term.example.com
+//	  - https://admin.example.com
+//	label:
+//	  site: mtl
+//
+// Lists are joined with commas, except for flags that can be repeated, which
+// get one value per item. Mappings are for repeatable key=value flags.
+//
+// Settings from the file replace the flags' defaults, so flags and their
+// environment variables still win over the file.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v2"
+)
+
+// The flags' built-in defaults, before Load replaced them, for Reload to go
+// back to when a setting is removed from the file.
+var builtin = make(map[string][]string)
+
+// Path returns the config file given with --config in args, or in envar.
+// The flags aren't parsed yet when we need it: the file's settings have to
+// be in place before they are.
+func Path(args []string, envar string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if arg == "--config" && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(arg, "--config=") {
+			return strings.TrimPrefix(arg, "--config=")
+		}
+	}
+	return os.Getenv(envar)
+}
+
+// Load makes the settings in the file at path the defaults of app's flags.
+// It must be called before app parses the command line.
+func Load(app *kingpin.Application, path string) error {
+	settings, err := read(app, path)
+	if err != nil {
+		return err
+	}
+
+	for name, values := range settings {
+		model := app.GetFlag(name).Model()
+		// checked now so that the error points at the file, except for
+		// repeatable flags, which would keep the value
+		if !cumulative(model) {
+			if err := model.Value.Set(values[0]); err != nil {
+				return fmt.Errorf("%s: %s: %v", path, name, err)
+			}
+		}
+		builtin[name] = model.Default
+		app.GetFlag(name).Default(values...)
+	}
+	return nil
+}
+
+// Reload reads the file at path again and applies the settings listed in
+// names, except those given on the command line (args) or in the
+// environment. A setting removed from the file goes back to its default.
+// If a value is invalid, or check fails once they are applied, all settings
+// are left as they were. Reload returns the names of the settings changed.
+func Reload(app *kingpin.Application, path string, args []string, names []string, check func() error) (changed []string, err error) {
+	settings, err := read(app, path)
+	if err != nil {
+		return nil, err
+	}
+
+	previous := make(map[string]string)
+	defer func() {
+		if err != nil {
+			for name, value := range previous {
+				app.GetFlag(name).Model().Value.Set(value)
+			}
+			changed = nil
+		}
+	}()
+
+	for _, name := range names {
+		model := app.GetFlag(name).Model()
+		if fromUser(model, args) {
+			continue
+		}
+
+		values := builtin[name]
+		if values == nil {
+			values = model.Default
+		}
+		if value, ok := settings[name]; ok {
+			values = value
+		}
+
+		old := model.Value.String()
+		previous[name] = old
+		for _, value := range values {
+			if err = model.Value.Set(value); err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", path, name, err)
+			}
+		}
+		if model.Value.String() != old {
+			changed = append(changed, name)
+		}
+	}
+
+	if check != nil {
+		err = check()
+	}
+	return changed, err
+}
+
+// read returns the settings in the file, as the strings the flags parse.
+func read(app *kingpin.Application, path string) (map[string][]string, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(buf, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	settings := make(map[string][]string)
+	for name, value := range raw {
+		if name == "config" || app.GetFlag(name) == nil {
+			return nil, fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+		repeatable := cumulative(app.GetFlag(name).Model())
+
+		switch v := value.(type) {
+		case nil:
+			return nil, fmt.Errorf("%s: %s: missing value", path, name)
+		case map[interface{}]interface{}:
+			if !repeatable {
+				return nil, fmt.Errorf("%s: %s: expected a value, got a mapping", path, name)
+			}
+			for key, item := range v {
+				settings[name] = append(settings[name], fmt.Sprintf("%v=%v", key, item))
+			}
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			if repeatable {
+				settings[name] = items
+			} else {
+				// the comma separated flags, like cors
+				settings[name] = []string{strings.Join(items, ",")}
+			}
+		default:
+			settings[name] = []string{fmt.Sprint(v)}
+		}
+	}
+	return settings, nil
+}
+
+// cumulative tells whether the flag can be repeated.
+func cumulative(model *kingpin.FlagModel) bool {
+	value, ok := model.Value.(interface {
+		IsCumulative() bool
+	})
+	return ok && value.IsCumulative()
+}
+
+// fromUser tells whether the flag was given on the command line or in its
+// environment variable, which the file doesn't override.
+func fromUser(model *kingpin.FlagModel, args []string) bool {
+	if len(model.Envar) > 0 && len(os.Getenv(model.Envar)) > 0 {
+		return true
+	}
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if arg == "--"+model.Name || arg == "--no-"+model.Name || strings.HasPrefix(arg, "--"+model.Name+"=") {
+			return true
+		}
+		if model.Short != 0 && !strings.HasPrefix(arg, "--") && strings.HasPrefix(arg, "-"+string(model.Short)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+type testFlags struct {
+	app    *kingpin.Application
+	rate   *int
+	cors   *string
+	header *[]string
+	label  *map[string]string
+}
+
+func newTestFlags() *testFlags {
+	// the defaults Load replaced are per flag name
+	builtin = make(map[string][]string)
+	app := kingpin.New("test", "")
+	return &testFlags{
+		app:    app,
+		rate:   app.Flag("rate", "").Default("0").OverrideDefaultFromEnvar("WWS_TEST_RATE").Int(),
+		cors:   app.Flag("cors", "").Default("").String(),
+		header: app.Flag("header", "").Strings(),
+		label:  app.Flag("label", "").StringMap(),
+	}
+}
+
+func writeFile(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeFile(t, path, contents)
+	return path
+}
+
+func TestFlagsWinOverFile(t *testing.T) {
+	path := testFile(t, "rate: 10\n")
+
+	f := newTestFlags()
+	if err := Load(f.app, path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.app.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	if *f.rate != 10 {
+		t.Errorf("rate = %d from the file, want 10", *f.rate)
+	}
+
+	f = newTestFlags()
+	Load(f.app, path)
+	if _, err := f.app.Parse([]string{"--rate", "5"}); err != nil {
+		t.Fatal(err)
+	}
+	if *f.rate != 5 {
+		t.Errorf("rate = %d with --rate 5, want 5", *f.rate)
+	}
+
+	os.Setenv("WWS_TEST_RATE", "7")
+	defer os.Unsetenv("WWS_TEST_RATE")
+	f = newTestFlags()
+	Load(f.app, path)
+	if _, err := f.app.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	if *f.rate != 7 {
+		t.Errorf("rate = %d with WWS_TEST_RATE=7, want 7", *f.rate)
+	}
+}
+
+func TestListsAndMappings(t *testing.T) {
+	path := testFile(t, `
+cors:
+  - https://a.example.com
+  - https://b.example.com
+header:
+  - "X-A: 1"
+  - "X-B: 2"
+label:
+  site: mtl
+`)
+	f := newTestFlags()
+	if err := Load(f.app, path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.app.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	if *f.cors != "https://a.example.com,https://b.example.com" {
+		t.Errorf("cors = %q, want the list joined with commas", *f.cors)
+	}
+	if !reflect.DeepEqual(*f.header, []string{"X-A: 1", "X-B: 2"}) {
+		t.Errorf("header = %q, want one value per item", *f.header)
+	}
+	if !reflect.DeepEqual(*f.label, map[string]string{"site": "mtl"}) {
+		t.Errorf("label = %v", *f.label)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for _, contents := range []string{
+		"rate: fast\n",
+		"unknown: 1\n",
+		"rate:\n",
+		"rate:\n  a: 1\n",
+	} {
+		f := newTestFlags()
+		if err := Load(f.app, testFile(t, contents)); err == nil {
+			t.Errorf("loaded %q", contents)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := testFile(t, "rate: 10\ncors: https://a.example.com\n")
+	f := newTestFlags()
+	if err := Load(f.app, path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.app.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, path, "rate: 20\ncors: https://a.example.com\n")
+	changed, err := Reload(f.app, path, nil, []string{"rate", "cors"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *f.rate != 20 || !reflect.DeepEqual(changed, []string{"rate"}) {
+		t.Errorf("rate = %d, changed %v", *f.rate, changed)
+	}
+
+	// removed from the file: back to the built-in default
+	writeFile(t, path, "cors: https://a.example.com\n")
+	if _, err := Reload(f.app, path, nil, []string{"rate"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if *f.rate != 0 {
+		t.Errorf("rate = %d once removed from the file, want 0", *f.rate)
+	}
+
+	// given on the command line: left alone
+	writeFile(t, path, "rate: 30\n")
+	if _, err := Reload(f.app, path, []string{"--rate=1"}, []string{"rate"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if *f.rate != 0 {
+		t.Errorf("rate = %d, the file overrode the command line", *f.rate)
+	}
+}
+
+func TestReloadRollback(t *testing.T) {
+	path := testFile(t, "rate: 10\ncors: https://a.example.com\n")
+	f := newTestFlags()
+	if err := Load(f.app, path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.app.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, path, "rate: 20\ncors: https://b.example.com\n")
+	changed, err := Reload(f.app, path, nil, []string{"rate", "cors"}, func() error {
+		return errors.New("no")
+	})
+	if err == nil || changed != nil {
+		t.Errorf("check failed, got %v, %v", changed, err)
+	}
+	if *f.rate != 10 || *f.cors != "https://a.example.com" {
+		t.Errorf("rate = %d, cors = %q, want them as they were", *f.rate, *f.cors)
+	}
+
+	// an invalid value changes nothing either
+	writeFile(t, path, "rate: 20\ncors: https://b.example.com\nunknown: 1\n")
+	if _, err := Reload(f.app, path, nil, []string{"rate", "cors"}, nil); err == nil {
+		t.Error("reloaded an invalid file")
+	}
+	if *f.rate != 10 {
+		t.Errorf("rate = %d, want 10", *f.rate)
+	}
+}
@@ -0,0 +1,337 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/time/rate"
+)
+
+// The guard protects the public endpoints from scans and floods: it rate
+// limits channel creation and websocket upgrades per client IP, bans IPs
+// that keep trying unknown channel IDs, and decides how long those get
+// tar-trapped.
+type guard struct {
+	mu       sync.Mutex
+	visitors map[string]*visitor
+	trapped  int64 // connections currently held in the tar-trap, atomic
+	counters guardCounters
+	settings func() Options
+	stop     chan struct{} // closed once the hub shut down
+	stopOnce sync.Once
+}
+
+type visitor struct {
+	create      *rate.Limiter
+	upgrade     *rate.Limiter
+	unknown     int // unknown channel attempts since windowStart
+	windowStart time.Time
+	bannedUntil time.Time
+	lastSeen    time.Time
+}
+
+// Updated atomically, listed as is by the admin API.
+type guardCounters struct {
+	CreateLimited  uint64 `json:"create_limited"`
+	UpgradeLimited uint64 `json:"upgrade_limited"`
+	UnknownChannel uint64 `json:"unknown_channel"`
+	Bans           uint64 `json:"bans"`
+	BannedRejected uint64 `json:"banned_rejected"`
+	TarTrapped     uint64 `json:"tar_trapped"`
+}
+
+type guardStats struct {
+	guardCounters
+	Trapped int64                `json:"trapped"`
+	Banned  map[string]time.Time `json:"banned"`
+}
+
+// Visitors not seen for this long are forgotten, unless they are banned.
+const visitorTTL = 10 * time.Minute
+
+// Connections held in the tar-trap at once, if TarTrapMax isn't set.
+const defaultTarTrapMax = 100
+
+func newGuard(settings func() Options) *guard {
+	g := &guard{visitors: make(map[string]*visitor), settings: settings, stop: make(chan struct{})}
+	go g.forgetIdle()
+	return g
+}
+
+// remoteIP is the IP the request came from, used to tell clients apart.
+// Behind a trusted proxy, forwarded rewrote it.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// parseNets parses IPs and CIDRs.
+func parseNets(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", s)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwarded takes the client IP from X-Forwarded-For or X-Real-IP, for
+// requests coming from one of the TrustedProxies. Anyone else could send
+// those headers to dodge the per-IP limits and bans, so they're ignored. In
+// X-Forwarded-For, the client is the last address that isn't a trusted
+// proxy: the ones before it could have been made up by the client.
+func (h *Hub) forwarded(handler http.Handler) http.Handler {
+	if len(h.trusted) == 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer := net.ParseIP(remoteIP(r))
+		if peer == nil || !contains(h.trusted, peer) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		var client net.IP
+		if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+			hops := strings.Split(strings.Join(xff, ","), ",")
+			for i := len(hops) - 1; i >= 0; i-- {
+				ip := net.ParseIP(strings.TrimSpace(hops[i]))
+				if ip == nil {
+					break
+				}
+				client = ip
+				if !contains(h.trusted, ip) {
+					break
+				}
+			}
+		} else if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+			client = ip
+		}
+
+		if client != nil {
+			r2 := *r
+			r2.RemoteAddr = net.JoinHostPort(client.String(), "0")
+			r = &r2
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// visitor must be called with g.mu held.
+func (g *guard) visitor(ip string) *visitor {
+	v, ok := g.visitors[ip]
+	if !ok {
+		opts := g.settings()
+		v = &visitor{
+			create:  rate.NewLimiter(perMinute(opts.CreateRate), opts.CreateRate),
+			upgrade: rate.NewLimiter(perMinute(opts.UpgradeRate), opts.UpgradeRate),
+		}
+		g.visitors[ip] = v
+	}
+	v.lastSeen = time.Now()
+	return v
+}
+
+func perMinute(n int) rate.Limit {
+	if n <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(float64(n) / 60)
+}
+
+// limit wraps an endpoint, turning away banned IPs and those going over
+// the given per-IP rate (one of the visitor's limiters).
+func (g *guard) limit(which func(*visitor) *rate.Limiter, limited *uint64, handle http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		g.mu.Lock()
+		v := g.visitor(remoteIP(r))
+		banned := time.Now().Before(v.bannedUntil)
+		allowed := banned || which(v).Allow()
+		g.mu.Unlock()
+
+		if banned {
+			atomic.AddUint64(&g.counters.BannedRejected, 1)
+			http.Error(w, "banned", http.StatusForbidden)
+			return
+		}
+		if !allowed {
+			atomic.AddUint64(limited, 1)
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		handle(w, r)
+	}
+}
+
+// guarded applies one of the guard's limits to a router handle.
+func guarded(limit func(http.HandlerFunc) http.HandlerFunc, handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		limit(func(w http.ResponseWriter, r *http.Request) {
+			handle(w, r, p)
+		})(w, r)
+	}
+}
+
+func (g *guard) limitCreate(handle http.HandlerFunc) http.HandlerFunc {
+	return g.limit(func(v *visitor) *rate.Limiter { return v.create }, &g.counters.CreateLimited, handle)
+}
+
+func (g *guard) limitUpgrade(handle http.HandlerFunc) http.HandlerFunc {
+	return g.limit(func(v *visitor) *rate.Limiter { return v.upgrade }, &g.counters.UpgradeLimited, handle)
+}
+
+// unknownChannel records an attempt to join a channel that doesn't exist,
+// banning the IP for BanTime once it made BanAfter attempts within that
+// same time.
+func (g *guard) unknownChannel(ip string) {
+	atomic.AddUint64(&g.counters.UnknownChannel, 1)
+	opts := g.settings()
+	banAfter, banTime := opts.BanAfter, opts.BanTime
+	if banAfter <= 0 {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	v := g.visitor(ip)
+	now := time.Now()
+	if now.Sub(v.windowStart) > banTime {
+		v.unknown = 0
+		v.windowStart = now
+	}
+	v.unknown++
+	if v.unknown >= banAfter && now.After(v.bannedUntil) {
+		v.bannedUntil = now.Add(banTime)
+		atomic.AddUint64(&g.counters.Bans, 1)
+	}
+}
+
+// tarTrap holds a client that asked for an unknown channel for TarTrap
+// before closing it, slowing scanners down. Once TarTrapMax clients are
+// held, the others are closed right away so that a scan can't pile them up.
+func (g *guard) tarTrap(client *Client) {
+	opts := g.settings()
+	tarTrap, max := opts.TarTrap, opts.TarTrapMax
+	if max == 0 {
+		max = defaultTarTrapMax
+	}
+	if tarTrap <= 0 || atomic.AddInt64(&g.trapped, 1) > int64(max) {
+		if tarTrap > 0 {
+			atomic.AddInt64(&g.trapped, -1)
+		}
+		go client.CloseWith(closeChannelUnknown, "channel unknown")
+		return
+	}
+
+	atomic.AddUint64(&g.counters.TarTrapped, 1)
+	go func() {
+		time.Sleep(tarTrap)
+		client.CloseWith(closeChannelUnknown, "channel unknown")
+		atomic.AddInt64(&g.trapped, -1)
+	}()
+}
+
+// updateLimits applies reloaded rates to the IPs we already know.
+func (g *guard) updateLimits() {
+	opts := g.settings()
+	createRate, upgradeRate := opts.CreateRate, opts.UpgradeRate
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, v := range g.visitors {
+		v.create.SetLimit(perMinute(createRate))
+		v.create.SetBurst(createRate)
+		v.upgrade.SetLimit(perMinute(upgradeRate))
+		v.upgrade.SetBurst(upgradeRate)
+	}
+}
+
+func (g *guard) stats() guardStats {
+	stats := guardStats{
+		guardCounters: guardCounters{
+			CreateLimited:  atomic.LoadUint64(&g.counters.CreateLimited),
+			UpgradeLimited: atomic.LoadUint64(&g.counters.UpgradeLimited),
+			UnknownChannel: atomic.LoadUint64(&g.counters.UnknownChannel),
+			Bans:           atomic.LoadUint64(&g.counters.Bans),
+			BannedRejected: atomic.LoadUint64(&g.counters.BannedRejected),
+			TarTrapped:     atomic.LoadUint64(&g.counters.TarTrapped),
+		},
+		Trapped: atomic.LoadInt64(&g.trapped),
+		Banned:  make(map[string]time.Time),
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	for ip, v := range g.visitors {
+		if now.Before(v.bannedUntil) {
+			stats.Banned[ip] = v.bannedUntil
+		}
+	}
+	return stats
+}
+
+// close stops forgetIdle.
+func (g *guard) close() {
+	g.stopOnce.Do(func() { close(g.stop) })
+}
+
+// forgetIdle runs until the hub shuts down.
+func (g *guard) forgetIdle() {
+	ticker := time.NewTicker(visitorTTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			g.forget(now)
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+func (g *guard) forget(now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for ip, v := range g.visitors {
+		if now.Sub(v.lastSeen) > visitorTTL && now.After(v.bannedUntil) {
+			delete(g.visitors, ip)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const unknownChannel = "00000000-0000-0000-0000-000000000000"
+
+// testStatus POSTs /create, returning the status.
+func testStatus(t *testing.T, url string) int {
+	t.Helper()
+	resp, err := http.Post(url+"/create", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestForwarded(t *testing.T) {
+	h, err := NewHub(&Options{TrustedProxies: []string{"10.0.0.5", "10.1.0.0/16"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	handler := h.forwarded(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = remoteIP(r)
+	}))
+
+	for _, test := range []struct {
+		peer, xff, realIP, want string
+	}{
+		{"192.0.2.1:1234", "", "", "192.0.2.1"},
+		// anyone else's headers are made up
+		{"192.0.2.1:1234", "198.51.100.7", "198.51.100.8", "192.0.2.1"},
+		{"10.0.0.5:1234", "", "", "10.0.0.5"},
+		{"10.0.0.5:1234", "198.51.100.7", "", "198.51.100.7"},
+		{"10.0.0.5:1234", "", "198.51.100.8", "198.51.100.8"},
+		// the client made up the first address, our proxies added the others
+		{"10.0.0.5:1234", "203.0.113.9, 198.51.100.7, 10.1.2.3", "", "198.51.100.7"},
+		{"10.0.0.5:1234", "10.1.2.3, 10.1.2.4", "", "10.1.2.3"},
+		{"10.0.0.5:1234", "garbage", "", "10.0.0.5"},
+	} {
+		r := httptest.NewRequest("GET", "/health", nil)
+		r.RemoteAddr = test.peer
+		if len(test.xff) > 0 {
+			r.Header.Set("X-Forwarded-For", test.xff)
+		}
+		if len(test.realIP) > 0 {
+			r.Header.Set("X-Real-IP", test.realIP)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if got != test.want {
+			t.Errorf("from %s, X-Forwarded-For %q, X-Real-IP %q: got %s, want %s", test.peer, test.xff, test.realIP, got, test.want)
+		}
+	}
+}
+
+func TestTrustedProxiesInvalid(t *testing.T) {
+	if _, err := NewHub(&Options{TrustedProxies: []string{"10.0.0.0/33"}}); err == nil {
+		t.Error("accepted an invalid CIDR")
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	h, srv := testConnector(t, &Options{CreateRate: 2, UpgradeRate: 2})
+	id := testCreate(t, srv, "")
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		if got := testStatus(t, srv.URL); got != want {
+			t.Errorf("create %d: got %d, want %d", i, got, want)
+		}
+	}
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws/tunnel/" + id
+	for i, want := range []int{http.StatusSwitchingProtocols, http.StatusSwitchingProtocols, http.StatusTooManyRequests} {
+		ws, resp, _ := websocket.DefaultDialer.Dial(url, nil)
+		if ws != nil {
+			ws.Close()
+		}
+		if resp == nil || resp.StatusCode != want {
+			t.Errorf("upgrade %d: got %v, want %d", i, resp, want)
+		}
+	}
+
+	stats := h.guard.stats()
+	if stats.CreateLimited != 1 || stats.UpgradeLimited != 1 {
+		t.Errorf("counted %d creates and %d upgrades limited", stats.CreateLimited, stats.UpgradeLimited)
+	}
+}
+
+func TestBanAfter(t *testing.T) {
+	h, srv := testConnector(t, &Options{BanAfter: 2, BanTime: time.Minute})
+	for i := 0; i < 2; i++ {
+		if code := testCloseCode(t, testDial(t, srv, "tunnel/"+unknownChannel)); code != closeChannelUnknown {
+			t.Fatalf("closed with %d, want %d", code, closeChannelUnknown)
+		}
+	}
+
+	// banned from everything guarded
+	if got := testStatus(t, srv.URL); got != http.StatusForbidden {
+		t.Errorf("create once banned: got %d", got)
+	}
+	stats := h.guard.stats()
+	if stats.Bans != 1 || stats.BannedRejected != 1 || len(stats.Banned) != 1 {
+		t.Errorf("stats: %+v", stats)
+	}
+}
+
+func TestTarTrap(t *testing.T) {
+	h, srv := testConnector(t, &Options{TarTrap: 300 * time.Millisecond, TarTrapMax: 1})
+
+	start := time.Now()
+	held := testDial(t, srv, "tunnel/"+unknownChannel)
+	// the trap is full: closed right away
+	if code := testCloseCode(t, testDial(t, srv, "tunnel/"+unknownChannel)); code != closeChannelUnknown {
+		t.Errorf("closed with %d", code)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("held %v over TarTrapMax", elapsed)
+	}
+	if code := testCloseCode(t, held); code != closeChannelUnknown {
+		t.Errorf("closed with %d", code)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("held only %v", elapsed)
+	}
+
+	stats := h.guard.stats()
+	if stats.TarTrapped != 1 {
+		t.Errorf("%d tar-trapped, want 1", stats.TarTrapped)
+	}
+}
+
+func TestTarTrapDefaultMax(t *testing.T) {
+	h, srv := testConnector(t, &Options{TarTrap: time.Minute})
+	testDial(t, srv, "tunnel/"+unknownChannel)
+	for deadline := time.Now().Add(5 * time.Second); h.guard.stats().Trapped != 1; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("not held without a TarTrapMax")
+		}
+	}
+}
+
+func TestForgetIdle(t *testing.T) {
+	h, err := NewHub(&Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := h.guard
+	g.mu.Lock()
+	g.visitor("192.0.2.1")
+	g.visitor("192.0.2.2").bannedUntil = time.Now().Add(2 * visitorTTL)
+	g.visitor("192.0.2.3")
+	g.mu.Unlock()
+
+	g.forget(time.Now().Add(visitorTTL + time.Second))
+	if len(g.visitors) != 1 || g.visitors["192.0.2.2"] == nil {
+		t.Errorf("kept %v, want only the banned one", g.visitors)
+	}
+
+	// stops with the hub
+	h.Shutdown(context.Background())
+	select {
+	case <-g.stop:
+	default:
+		t.Error("still running after Shutdown")
+	}
+}
@@ -0,0 +1,77 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// The admin API is meant to be served on its own listener, kept on a private
+// interface: it lists channel IDs, which are all it takes to join
+// a channel.
+
+type channelInfo struct {
+	ID              string    `json:"id"`
+	Type            string    `json:"type"`
+	Direct          string    `json:"direct,omitempty"` // ssh server of a direct channel
+	Via             string    `json:"via,omitempty"`    // hops of a chained channel
+	Created         time.Time `json:"created"`
+	Proxy           bool      `json:"proxy"`
+	Tunnel          bool      `json:"tunnel"`
+	Watchers        int       `json:"watchers"`
+	FromProxyBytes  uint64    `json:"from_proxy_bytes"`
+	FromTunnelBytes uint64    `json:"from_tunnel_bytes"`
+	FromProxyRate   float64   `json:"from_proxy_rate"`  // bytes/s
+	FromTunnelRate  float64   `json:"from_tunnel_rate"` // bytes/s
+}
+
+// AdminHandler serves the admin API: /channels, /agents and /abuse.
+func (hub *Hub) AdminHandler() http.Handler {
+	router := httprouter.New()
+	router.GET("/channels", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		reply := make(chan []channelInfo)
+		hub.listChannels <- reply
+		writeJSON(w, <-reply)
+	})
+	router.GET("/agents", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		reply := make(chan []agentInfo)
+		hub.listAgents <- reply
+		writeJSON(w, <-reply)
+	})
+	router.GET("/abuse", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		writeJSON(w, hub.guard.stats())
+	})
+	return router
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// channelInfos must only be called from the hub loop.
+func (h *Hub) channelInfos() []channelInfo {
+	infos := make([]channelInfo, 0, len(h.channels))
+	for _, channel := range h.channels {
+		infos = append(infos, channelInfo{
+			ID:              channel.id.String(),
+			Type:            channel.kind,
+			Direct:          channel.direct,
+			Via:             channel.via(),
+			Created:         channel.created,
+			Proxy:           channel.proxy != nil,
+			Tunnel:          channel.tunnel != nil,
+			Watchers:        len(channel.watchers),
+			FromProxyBytes:  atomic.LoadUint64(&channel.fromProxy.total),
+			FromTunnelBytes: atomic.LoadUint64(&channel.fromTunnel.total),
+			FromProxyRate:   channel.fromProxy.rate,
+			FromTunnelRate:  channel.fromTunnel.rate,
+		})
+	}
+	return infos
+}
@@ -0,0 +1,188 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Agents are long-lived proxies: wwscat --agent keeps a websocket open on
+// /ws/agent/<name>, announcing its labels in the query string. A channel
+// created with /create?agent=<name> is handed to the agent with an "attach"
+// control message, and the agent connects a proxy to it like any other.
+//
+// A new connection with the same name replaces the previous one, closed with
+// closeAgentReplaced, if it presents the same credentials (the Authorization
+// header Authorize checked, or none for both). Anyone else is refused with
+// closeAgentTaken while it's connected, so that an agent can't be hijacked
+// by name.
+
+type agent struct {
+	name      string
+	labels    map[string]string
+	addr      string // remote IP
+	connected time.Time
+	lastSeen  int64 // unix nanos, updated atomically on pongs and messages
+	client    *Client
+	done      chan struct{} // closed once the agent disconnected
+	// sha256 of the Authorization header it connected with, nil without one
+	credential []byte
+}
+
+type agentInfo struct {
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels"`
+	Addr      string            `json:"addr"`
+	Connected time.Time         `json:"connected"`
+	LastSeen  time.Time         `json:"last_seen"`
+}
+
+// Asks the hub to hand channel to an agent.
+type agentRequest struct {
+	name    string
+	channel *Channel
+	reply   chan error
+}
+
+var errAgentOffline = errors.New("agent offline")
+
+func (a *agent) seen() {
+	atomic.StoreInt64(&a.lastSeen, time.Now().UnixNano())
+}
+
+func (a *agent) info() agentInfo {
+	return agentInfo{
+		Name:      a.name,
+		Labels:    a.labels,
+		Addr:      a.addr,
+		Connected: a.connected,
+		LastSeen:  time.Unix(0, atomic.LoadInt64(&a.lastSeen)),
+	}
+}
+
+func serveAgent(hub *Hub, w http.ResponseWriter, r *http.Request, name string) {
+	ws, err := hub.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Print("upgrade:", err)
+		return
+	}
+	defer ws.Close()
+
+	labels := make(map[string]string)
+	for key, values := range r.URL.Query() {
+		labels[key] = values[0]
+	}
+	a := &agent{
+		name:      name,
+		labels:    labels,
+		addr:      remoteIP(r),
+		connected: time.Now(),
+		client:    &Client{hub: hub, ws: ws, addr: remoteIP(r), remoteType: "agent"},
+		done:      make(chan struct{}),
+	}
+	if auth := r.Header.Get("Authorization"); len(auth) > 0 {
+		sum := sha256.Sum256([]byte(auth))
+		a.credential = sum[:]
+	}
+	a.seen()
+	ws.SetPongHandler(func(string) error {
+		a.seen()
+		return nil
+	})
+
+	hub.registerAgent <- a
+	go a.keepalive()
+
+	// agents only send heartbeats, reading is for the pongs and the close
+	for {
+		if _, _, err := a.client.ReadMessage(); err != nil {
+			break
+		}
+		a.seen()
+	}
+	close(a.done)
+	hub.agentGone <- a
+}
+
+func (a *agent) keepalive() {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := a.client.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait)); err != nil {
+				a.client.ws.Close()
+				return
+			}
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// The agent side of the hub loop.
+
+func (h *Hub) setAgent(a *agent) {
+	if old, ok := h.agents[a.name]; ok && !hmac.Equal(old.credential, a.credential) {
+		log.Printf("Refusing agent %s from %s, connected from %s with other credentials\n", a.name, a.addr, old.addr)
+		go a.client.CloseWith(closeAgentTaken, "agent name in use")
+		return
+	} else if ok {
+		log.Printf("Agent %s reconnected from %s, closing previous connection from %s\n", a.name, a.addr, old.addr)
+		go old.client.CloseWith(closeAgentReplaced, "replaced by a new connection")
+	} else {
+		log.Printf("Agent %s online from %s\n", a.name, a.addr)
+	}
+	h.agents[a.name] = a
+}
+
+func (h *Hub) removeAgent(a *agent) {
+	// unless it was already replaced
+	if h.agents[a.name] == a {
+		log.Printf("Agent %s offline\n", a.name)
+		delete(h.agents, a.name)
+	}
+}
+
+// openAgentChannel creates the channel and asks the agent to connect its
+// proxy side.
+func (h *Hub) openAgentChannel(req agentRequest) {
+	a, ok := h.agents[req.name]
+	if !ok {
+		req.reply <- errAgentOffline
+		return
+	}
+
+	h.addChannel(req.channel)
+	go func() {
+		if err := sendControl(a.client, controlMessage{Type: controlAttach, Channel: req.channel.id.String()}); err != nil {
+			log.Printf("Couldn't hand channel ID %v to agent %s: %v\n", req.channel.id, a.name, err)
+		}
+	}()
+	req.reply <- nil
+}
+
+func (h *Hub) agentInfos() []agentInfo {
+	infos := make([]agentInfo, 0, len(h.agents))
+	for _, a := range h.agents {
+		infos = append(infos, a.info())
+	}
+	return infos
+}
+
+// closeAgents tells the agents we're going away, so that they reconnect.
+// Must only be called from the hub loop.
+func (h *Hub) closeAgents() {
+	for name, a := range h.agents {
+		go a.client.CloseWith(websocket.CloseGoingAway, goingAwayReason)
+		delete(h.agents, name)
+	}
+}
@@ -0,0 +1,166 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testAgents authorizes the agents presenting "Bearer <their name>-token",
+// or "Bearer spare" for any name.
+func testAgents(r *http.Request, req Request) error {
+	if req.Op != OpAgent {
+		return nil
+	}
+	auth := r.Header.Get("Authorization")
+	if auth != "Bearer "+req.Agent+"-token" && auth != "Bearer spare" {
+		return errors.New("invalid agent token")
+	}
+	return nil
+}
+
+func dialAgent(t *testing.T, url, name, token string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	header := http.Header{}
+	if len(token) > 0 {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	ws, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/ws/agent/"+name+"?site=mtl", header)
+	if ws != nil {
+		t.Cleanup(func() { ws.Close() })
+	}
+	return ws, resp, err
+}
+
+// waitAgent waits for the agent to be online.
+func waitAgent(t *testing.T, h *Hub, name string) agentInfo {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		reply := make(chan []agentInfo)
+		h.listAgents <- reply
+		for _, info := range <-reply {
+			if info.Name == name {
+				return info
+			}
+		}
+	}
+	t.Fatalf("agent %s not online", name)
+	return agentInfo{}
+}
+
+// readAttach reads the channel the agent is asked to attach to.
+func readAttach(t *testing.T, ws *websocket.Conn) string {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, buf, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg controlMessage
+	if err := json.Unmarshal(buf, &msg); err != nil || msg.Type != controlAttach {
+		t.Fatalf("got %s, want an attach message", buf)
+	}
+	return msg.Channel
+}
+
+func TestAgentRegistration(t *testing.T) {
+	h, srv := testConnector(t, &Options{Authorize: testAgents})
+
+	if _, resp, err := dialAgent(t, srv.URL, "db", "wrong"); err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("wrong token: %v", err)
+	}
+	if _, _, err := dialAgent(t, srv.URL, "db", "db-token"); err != nil {
+		t.Fatal(err)
+	}
+	if info := waitAgent(t, h, "db"); info.Labels["site"] != "mtl" {
+		t.Errorf("labels %v", info.Labels)
+	}
+}
+
+func TestAgentChannel(t *testing.T) {
+	h, srv := testConnector(t, &Options{Authorize: testAgents})
+	ws, _, err := dialAgent(t, srv.URL, "db", "db-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitAgent(t, h, "db")
+
+	id := testCreate(t, srv, "agent=db")
+	if attached := readAttach(t, ws); attached != id {
+		t.Errorf("asked to attach to %s, created %s", attached, id)
+	}
+
+	resp, err := http.Post(srv.URL+"/create?agent=offline", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("offline agent: got %s", resp.Status)
+	}
+}
+
+func TestAgentReplacement(t *testing.T) {
+	h, srv := testConnector(t, &Options{Authorize: testAgents})
+	first, _, err := dialAgent(t, srv.URL, "db", "db-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitAgent(t, h, "db")
+
+	// other credentials: refused while the first is connected
+	other, _, err := dialAgent(t, srv.URL, "db", "spare")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := testCloseCode(t, other); code != closeAgentTaken {
+		t.Errorf("other credentials closed with %d, want %d", code, closeAgentTaken)
+	}
+
+	// the same ones: replaces it
+	second, _, err := dialAgent(t, srv.URL, "db", "db-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := testCloseCode(t, first); code != closeAgentReplaced {
+		t.Errorf("replaced agent closed with %d, want %d", code, closeAgentReplaced)
+	}
+
+	id := testCreate(t, srv, "agent=db")
+	if attached := readAttach(t, second); attached != id {
+		t.Errorf("asked to attach to %s, created %s", attached, id)
+	}
+}
+
+func TestAgentReplacementNoCredentials(t *testing.T) {
+	h, srv := testConnector(t, &Options{})
+	first, _, err := dialAgent(t, srv.URL, "db", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitAgent(t, h, "db")
+
+	// without an Authorize hook, any credentials still don't match none
+	other, _, err := dialAgent(t, srv.URL, "db", "spare")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := testCloseCode(t, other); code != closeAgentTaken {
+		t.Errorf("credentials closed with %d, want %d", code, closeAgentTaken)
+	}
+
+	// none for both: replaces it
+	if _, _, err := dialAgent(t, srv.URL, "db", ""); err != nil {
+		t.Fatal(err)
+	}
+	if code := testCloseCode(t, first); code != closeAgentReplaced {
+		t.Errorf("replaced agent closed with %d, want %d", code, closeAgentReplaced)
+	}
+}
@@ -0,0 +1,90 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"encoding/json"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/wegel/wwscc/wsconn"
+)
+
+// The tunnel side of an ssh channel is usually a browser showing a
+// terminal. It talks to the connector with:
+//
+//   - binary frames: the data, keystrokes one way and terminal output the
+//     other;
+//   - text frames: JSON control messages, with a "type":
+//     "resize" (cols, rows), "ping" answered with "pong", "data" (data, a
+//     string) for clients that can't send binary frames, and "eof" from the
+//     client; "status" (message) while the session is set up and "exit"
+//     (status) when the shell exits, from the connector.
+//
+// With frames=text in its URL, a client gets the output in "data" messages
+// rather than binary frames. Either way, the output is cut on character
+// boundaries, so each message can be decoded as UTF-8 on its own.
+//
+// Text frames that aren't JSON control messages are taken as keystrokes,
+// from pages written before there was a protocol.
+
+// terminalWriter writes the output of a session to the tunnel side.
+type terminalWriter struct {
+	conn    *wsconn.Conn
+	text    bool   // in "data" messages
+	pending []byte // start of a character cut by the last Write
+}
+
+func newTerminalWriter(conn *wsconn.Conn, text bool) *terminalWriter {
+	return &terminalWriter{conn: conn, text: text}
+}
+
+func (w *terminalWriter) Write(b []byte) (int, error) {
+	buf := b
+	if len(w.pending) > 0 {
+		buf = append(w.pending, b...)
+		w.pending = nil
+	}
+	cut := wholeRunes(buf)
+	if cut < len(buf) {
+		w.pending = append([]byte(nil), buf[cut:]...)
+	}
+	if cut == 0 {
+		return len(b), nil
+	}
+
+	if !w.text {
+		if _, err := w.conn.Write(buf[:cut]); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	// invalid sequences become U+FFFD, text frames must be valid UTF-8
+	msg, err := json.Marshal(controlMessage{Type: controlData, Data: string(buf[:cut])})
+	if err != nil {
+		return 0, err
+	}
+	if err := w.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// wholeRunes is the length of b without the start of a character cut at
+// its end. Invalid sequences count as whole: waiting won't fix them.
+func wholeRunes(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i > len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(b)
+}
+
+func sendExit(c *Client, status int) error {
+	return sendControl(c, controlMessage{Type: controlExit, Status: &status})
+}
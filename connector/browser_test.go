@@ -0,0 +1,101 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/wegel/wwscc/wsconn"
+)
+
+func TestWholeRunes(t *testing.T) {
+	for _, test := range []struct {
+		data string
+		want int
+	}{
+		{"", 0},
+		{"abc", 3},
+		{"a\xc3", 1},
+		{"a\xc3\xa9", 3},
+		{"a\xe2\x82", 1},
+		{"\xf0\x9f\x98", 0},
+		{"\xf0\x9f\x98\x80", 4},
+		// invalid, waiting won't fix them
+		{"a\xff", 2},
+		{"\x82\xac", 2},
+	} {
+		if got := wholeRunes([]byte(test.data)); got != test.want {
+			t.Errorf("%q: got %d, want %d", test.data, got, test.want)
+		}
+	}
+}
+
+// recordSocket keeps the messages written to it.
+type recordSocket struct {
+	messages []recorded
+}
+
+type recorded struct {
+	messageType int
+	data        string
+}
+
+func (s *recordSocket) ReadMessage() (int, []byte, error) {
+	select {}
+}
+
+func (s *recordSocket) WriteMessage(messageType int, data []byte) error {
+	s.messages = append(s.messages, recorded{messageType, string(data)})
+	return nil
+}
+
+func (s *recordSocket) WriteControl(int, []byte, time.Time) error { return nil }
+func (s *recordSocket) SetWriteDeadline(time.Time) error          { return nil }
+func (s *recordSocket) LocalAddr() net.Addr                       { return nil }
+func (s *recordSocket) RemoteAddr() net.Addr                      { return nil }
+func (s *recordSocket) Close() error                              { return nil }
+
+func TestTerminalWriter(t *testing.T) {
+	// a euro sign cut across three writes, and one cut in two
+	writes := []string{"h\xe2", "\x82", "\xac!\xf0\x9f", "\x98\x80"}
+
+	socket := &recordSocket{}
+	w := newTerminalWriter(wsconn.New(socket), false)
+	for _, data := range writes {
+		if n, err := w.Write([]byte(data)); n != len(data) || err != nil {
+			t.Fatalf("wrote %d, %v", n, err)
+		}
+	}
+	want := []string{"h", "€!", "😀"}
+	if len(socket.messages) != len(want) {
+		t.Fatalf("got %v, want %q", socket.messages, want)
+	}
+	for i, m := range socket.messages {
+		if m.messageType != websocket.BinaryMessage || m.data != want[i] {
+			t.Errorf("message %d: got %d %q, want %q", i, m.messageType, m.data, want[i])
+		}
+	}
+
+	// the same in "data" messages, with an invalid byte replaced
+	socket = &recordSocket{}
+	w = newTerminalWriter(wsconn.New(socket), true)
+	for _, data := range append(writes, "\xff") {
+		w.Write([]byte(data))
+	}
+	want = append(want, "�")
+	if len(socket.messages) != len(want) {
+		t.Fatalf("got %v, want %q", socket.messages, want)
+	}
+	for i, m := range socket.messages {
+		var msg controlMessage
+		if m.messageType != websocket.TextMessage || json.Unmarshal([]byte(m.data), &msg) != nil ||
+			msg.Type != controlData || msg.Data != want[i] {
+			t.Errorf("message %d: got %d %s, want data %q", i, m.messageType, m.data, want[i])
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/wegel/wwscc/wwsclient"
+)
+
+// A chained channel (/create?via=mid,inner) goes through other connectors,
+// for networks several firewalls deep. We create a channel on the first hop,
+// passing it the rest of the chain along with the type, agent and direct= of
+// the request, and once our tunnel side is here, we connect to the hop's
+// channel as our proxy side. Each connector only knows its next hop, and
+// authenticates to it with that hop's headers.
+
+// Hop is another connector channels can be chained through.
+type Hop struct {
+	URL    string      // its base URL, http(s) or ws(s)
+	Header http.Header // sent to it, to authenticate
+}
+
+// nextHop is where a chained channel goes.
+type nextHop struct {
+	via    string   // the whole chain, for the admin API
+	name   string   // the first hop
+	url    *url.URL // the tunnel side of the channel on it
+	header http.Header
+}
+
+// createChained creates the channel on the next hop, then ours.
+func createChained(h *Hub, w http.ResponseWriter, r *http.Request, kind, via string) {
+	name, rest := via, ""
+	if i := strings.IndexByte(via, ','); i >= 0 {
+		name, rest = via[:i], via[i+1:]
+	}
+	hop, ok := h.options().Hops[name]
+	if !ok {
+		http.Error(w, "unknown hop "+name, http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	nextID, err := wwsclient.CreateChannel(r.Context(), hop.URL, &wwsclient.CreateOptions{
+		Type:   kind,
+		Agent:  query.Get("agent"),
+		Direct: query.Get("direct"),
+		Via:    rest,
+		Header: hop.Header,
+	})
+	if err != nil {
+		log.Printf("Couldn't create a channel on hop %s: %v\n", name, err)
+		if se, ok := err.(*wwsclient.StatusError); ok {
+			http.Error(w, fmt.Sprintf("hop %s: %s", name, se.Message), se.StatusCode)
+		} else {
+			http.Error(w, fmt.Sprintf("hop %s unreachable", name), http.StatusBadGateway)
+		}
+		return
+	}
+	next, err := tunnelURL(hop.URL, nextID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// the type is the last hop's business, we only relay
+	id, err := newChannel(h, r, &Channel{kind: kind, handler: Passthrough,
+		next: &nextHop{via: via, name: name, url: next, header: hop.Header}})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Write([]byte(id.String()))
+}
+
+// tunnelURL is the websocket URL of the tunnel side of channel id, on the
+// connector at base.
+func tunnelURL(base, id string) (*url.URL, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	}
+	u.Path = path.Join(u.Path, "/ws/tunnel", id)
+	return u, nil
+}
+
+// dialHop connects to the next hop as the proxy side of a chained channel,
+// passing on the parameters of its tunnel side (an ssh channel's username,
+// terminal size...).
+func dialHop(h *Hub, id uuid.UUID, next *nextHop, tunnel *Client) {
+	u := *next.url
+	u.RawQuery = tunnel.Params().Encode()
+	ws, resp, err := websocket.DefaultDialer.Dial(u.String(), next.header)
+	if err != nil {
+		if resp != nil {
+			err = fmt.Errorf("%v (%s)", err, resp.Status)
+		}
+		log.Printf("Couldn't reach hop %s for channel ID %v: %v\n", next.name, id, err)
+		tunnel.CloseWith(closeHopFailed, "couldn't reach hop "+next.name)
+		h.disconnected <- tunnel
+		return
+	}
+	defer ws.Close()
+
+	client := &Client{hub: h, ws: ws, addr: next.url.Host, channelID: id, params: url.Values{}, remoteType: "proxy", hop: true}
+	h.registerClient <- client
+	keepalive(client)
+}
+
+func (c *Channel) via() string {
+	if c.next == nil {
+		return ""
+	}
+	return c.next.via
+}
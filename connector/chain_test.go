@@ -0,0 +1,69 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTunnelURL(t *testing.T) {
+	for base, want := range map[string]string{
+		"http://inner:8080":        "ws://inner:8080/ws/tunnel/id",
+		"https://inner":            "wss://inner/ws/tunnel/id",
+		"https://inner/connector/": "wss://inner/connector/ws/tunnel/id",
+		"ws://inner":               "ws://inner/ws/tunnel/id",
+		"wss://inner/connector":    "wss://inner/connector/ws/tunnel/id",
+	} {
+		u, err := tunnelURL(base, "id")
+		if err != nil || u.String() != want {
+			t.Errorf("%s: got %v, %v, want %s", base, u, err, want)
+		}
+	}
+	if _, err := tunnelURL("://inner", "id"); err == nil {
+		t.Error("bogus URL accepted")
+	}
+}
+
+func TestChain(t *testing.T) {
+	h, inner := testConnector(t, &Options{})
+	_, outer := testConnector(t, &Options{Hops: map[string]Hop{"inner": {URL: inner.URL}}})
+
+	id := testCreate(t, outer, "via=inner")
+	tunnel := testDial(t, outer, "tunnel/"+id)
+	// the channel the outer connector created on the inner one
+	reply := make(chan []channelInfo)
+	h.listChannels <- reply
+	channels := <-reply
+	if len(channels) != 1 {
+		t.Fatalf("%d channels on the inner connector", len(channels))
+	}
+	proxy := testDial(t, inner, "proxy/"+channels[0].ID)
+
+	tunnel.WriteMessage(websocket.BinaryMessage, []byte("through both"))
+	if _, buf := testRead(t, proxy); string(buf) != "through both" {
+		t.Errorf("proxy got %q", buf)
+	}
+}
+
+func TestDialHopFailed(t *testing.T) {
+	// creating channels works, joining them doesn't
+	_, inner := testConnector(t, &Options{
+		Authorize: func(r *http.Request, req Request) error {
+			if req.Op == OpTunnel {
+				return errors.New("no tunnels")
+			}
+			return nil
+		},
+	})
+	_, outer := testConnector(t, &Options{Hops: map[string]Hop{"inner": {URL: inner.URL}}})
+
+	id := testCreate(t, outer, "via=inner")
+	tunnel := testDial(t, outer, "tunnel/"+id)
+	if code := testCloseCode(t, tunnel); code != closeHopFailed {
+		t.Errorf("closed with %d, want %d", code, closeHopFailed)
+	}
+}
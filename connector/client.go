@@ -0,0 +1,101 @@
+package connector
+
+import (
+	"io"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
+)
+
+type Client struct {
+	hub         *Hub
+	ws          *websocket.Conn
+	addr        string // remote IP
+	otherSide   *Client
+	channelID   uuid.UUID
+	remoteType  string
+	hop         bool // our own connection to the next connector, see chain.go
+	params      map[string][]string
+	meter       *meter           // bytes read from this side
+	limiter     *rate.Limiter    // nil when unlimited
+	identity    [2]*rate.Limiter // of its IP and agent, shared with their other channels
+	closeMu     sync.Mutex
+	closeCode   int // why this side went away, see SetCloseStatus
+	closeReason string
+	wmu         sync.Mutex
+	rmu         sync.Mutex
+}
+
+// Params are the query parameters this side connected with.
+func (c *Client) Params() url.Values {
+	return url.Values(c.params)
+}
+
+func (c *Client) WriteMessage(msgType int, message []byte) (err error) {
+	c.wmu.Lock()
+	err = c.ws.WriteMessage(msgType, message)
+	c.wmu.Unlock()
+	return
+}
+
+func (c *Client) NextWriter(msgType int) (w io.WriteCloser, err error) {
+	c.wmu.Lock()
+	w, err = c.ws.NextWriter(msgType)
+	c.wmu.Unlock()
+	return
+}
+
+func (c *Client) EnableWriteCompression(enable bool) {
+	c.wmu.Lock()
+	c.ws.EnableWriteCompression(enable)
+	c.wmu.Unlock()
+}
+
+// WriteControl may be called concurrently with the other write methods, so it
+// doesn't take the write lock. This lets pings through while a message is
+// being streamed with NextWriter.
+func (c *Client) WriteControl(msgType int, data []byte, deadline time.Time) error {
+	return c.ws.WriteControl(msgType, data, deadline)
+}
+
+// CloseWith sends a close frame with code and reason, then closes the
+// connection.
+func (c *Client) CloseWith(code int, reason string) {
+	if len(reason) > maxCloseReason {
+		reason = reason[:maxCloseReason]
+	}
+	c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait))
+	c.ws.Close()
+}
+
+func (c *Client) ReadMessage() (msgType int, message []byte, err error) {
+	c.rmu.Lock()
+	msgType, message, err = c.ws.ReadMessage()
+	c.rmu.Unlock()
+	return
+}
+
+func (c *Client) NextReader() (msgType int, r io.Reader, err error) {
+	c.rmu.Lock()
+	msgType, r, err = c.ws.NextReader()
+	c.rmu.Unlock()
+	return
+}
+
+func (c *Client) SetWriteDeadline(t time.Time) (err error) {
+	c.wmu.Lock()
+	err = c.ws.SetWriteDeadline(t)
+	c.wmu.Unlock()
+	return
+}
+
+func (c *Client) SetReadDeadline(t time.Time) (err error) {
+	c.rmu.Lock()
+	err = c.ws.SetReadDeadline(t)
+	c.rmu.Unlock()
+	return
+}
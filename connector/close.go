@@ -0,0 +1,81 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/gorilla/websocket"
+)
+
+// Close codes we send on top of the standard ones (normal closure, going
+// away...), from the range reserved for applications. wwscat maps each to its
+// own exit status.
+const (
+	closeTimeout        = 4000 // the other side stopped responding
+	closePeerLost       = 4001 // the other side dropped without a close frame
+	closeChannelUnknown = 4002
+	closeAuthFailed     = 4003 // the ssh server refused our credentials
+	closeSSHFailed      = 4004 // couldn't establish the ssh session
+	closeAgentReplaced  = 4005 // another agent connected with the same name
+	closeNotShared      = 4006 // the session can't be watched
+	closeHopFailed      = 4007 // couldn't reach the next connector of a chain
+	closeAgentTaken     = 4008 // an agent with other credentials has the name
+	closeExitStatus     = 4100 // + the exit status (0-255) of the ssh session
+)
+
+// A close frame payload is limited to 125 bytes, 2 of which hold the code.
+const maxCloseReason = 123
+
+// closeStatus turns the error that ended a read into the code and reason to
+// pass on to the other side. Codes that describe a connection without a
+// close frame (1005, 1006, 1015) may not be sent, so those become our own.
+func closeStatus(err error) (code int, reason string) {
+	if ce, ok := err.(*websocket.CloseError); ok {
+		switch ce.Code {
+		case websocket.CloseNoStatusReceived, websocket.CloseAbnormalClosure, websocket.CloseTLSHandshake:
+			return closePeerLost, "peer connection lost"
+		}
+		return ce.Code, ce.Text
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return closeTimeout, "peer timed out"
+	}
+	return closePeerLost, "peer connection lost"
+}
+
+func exitStatusClose(status int) (code int, reason string) {
+	if status < 0 || status > 255 {
+		status = 255
+	}
+	return closeExitStatus + status, fmt.Sprintf("exit status %d", status)
+}
+
+// SetCloseStatus records why this side went away, for the hub to tell the
+// other side: before the channel handler returns, or before sending the
+// client to hub.disconnected. The first status recorded wins.
+func (c *Client) SetCloseStatus(code int, reason string) {
+	c.closeMu.Lock()
+	if c.closeCode == 0 {
+		c.closeCode, c.closeReason = code, reason
+	}
+	c.closeMu.Unlock()
+}
+
+func (c *Client) hasCloseStatus() bool {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	return c.closeCode != 0
+}
+
+// closedWith returns the recorded close status, or closePeerLost if there
+// is none.
+func (c *Client) closedWith() (code int, reason string) {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.closeCode == 0 {
+		return closePeerLost, "peer connection lost"
+	}
+	return c.closeCode, c.closeReason
+}
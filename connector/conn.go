@@ -0,0 +1,98 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/wegel/wwscc/wsconn"
+)
+
+// NewConn makes a side of a channel a net.Conn, for channel handlers that
+// speak a protocol over it. It reads the data from binary frames and from
+// the text frames of the browser protocol (see browser.go), answers pings,
+// and writes binary frames. Reads end with io.EOF once the side says it's
+// done writing (wwscat at the end of its input).
+//
+// Close the Conn once done with it. That doesn't close the side: the hub
+// does, once the handler returned, telling it why the channel ended.
+func NewConn(client *Client) *wsconn.Conn {
+	return newConn(client, nil)
+}
+
+// newConn also calls onResize with the terminal size changes the side sends.
+func newConn(client *Client, onResize func(cols, rows int)) *wsconn.Conn {
+	conn := wsconn.New(clientSocket{client, onResize})
+	conn.OnRead = client.account
+	return conn
+}
+
+// clientSocket goes through the client's locks, compresses the messages
+// worth it, and leaves closing to the hub.
+type clientSocket struct {
+	*Client
+	onResize func(cols, rows int)
+}
+
+func (s clientSocket) ReadMessage() (msgType int, data []byte, err error) {
+	for {
+		msgType, data, err = s.Client.ReadMessage()
+		if err != nil || msgType != websocket.TextMessage {
+			return
+		}
+		msg, ok := parseControl(data)
+		if !ok {
+			return
+		}
+		switch msg.Type {
+		case controlEOF:
+			return 0, nil, io.EOF
+		case controlData:
+			return websocket.BinaryMessage, []byte(msg.Data), nil
+		case controlPing:
+			sendControl(s.Client, controlMessage{Type: controlPong})
+		case controlResize:
+			if s.onResize != nil {
+				s.onResize(msg.Cols, msg.Rows)
+			}
+		}
+		// other control messages aren't for us
+	}
+}
+
+// parseControl tells control messages from keystrokes sent as text by older
+// pages.
+func parseControl(data []byte) (msg controlMessage, ok bool) {
+	ok = bytes.HasPrefix(data, []byte("{")) && json.Unmarshal(data, &msg) == nil && len(msg.Type) > 0
+	return
+}
+
+func (s clientSocket) WriteMessage(msgType int, data []byte) error {
+	s.EnableWriteCompression(len(data) >= s.hub.options().CompressThreshold)
+	return s.Client.WriteMessage(msgType, data)
+}
+
+func (s clientSocket) WriteControl(msgType int, data []byte, deadline time.Time) error {
+	if msgType == websocket.CloseMessage {
+		return nil
+	}
+	return s.Client.WriteControl(msgType, data, deadline)
+}
+
+func (s clientSocket) LocalAddr() net.Addr {
+	return s.ws.LocalAddr()
+}
+
+func (s clientSocket) RemoteAddr() net.Addr {
+	return s.ws.RemoteAddr()
+}
+
+func (s clientSocket) Close() error {
+	return nil
+}
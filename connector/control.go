@@ -0,0 +1,59 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/gorilla/websocket"
+)
+
+// Control messages are sent as websocket text frames; wwscat reads data
+// from binary frames only.
+type controlMessage struct {
+	Type    string `json:"type"`
+	Target  string `json:"target,omitempty"`
+	Channel string `json:"channel,omitempty"`
+	Cols    int    `json:"cols,omitempty"`
+	Rows    int    `json:"rows,omitempty"`
+	Message string `json:"message,omitempty"`
+	Data    string `json:"data,omitempty"`
+	Status  *int   `json:"status,omitempty"`
+}
+
+const (
+	// Asks a wwscat proxy to dial a destination from its allow-list.
+	controlTarget = "target"
+	// Asks an agent to connect its proxy side to a channel.
+	controlAttach = "attach"
+	// The sender is done writing, it keeps reading. Passed through as is by
+	// tunnel channels.
+	controlEOF = "eof"
+	// The terminal on the tunnel side of an ssh channel was resized.
+	controlResize = "resize"
+	// Tells the tunnel side of an ssh channel how setting up the session is
+	// going, for it to show.
+	controlStatus = "status"
+	// The rest of the browser protocol, see browser.go.
+	controlData = "data"
+	controlPing = "ping"
+	controlPong = "pong"
+	controlExit = "exit"
+	// Someone joined or left a shared session, see watch.go.
+	controlNotice = "notice"
+)
+
+func sendControl(c *Client, msg controlMessage) error {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(websocket.TextMessage, buf)
+}
+
+func sendStatus(c *Client, message string) {
+	if err := sendControl(c, controlMessage{Type: controlStatus, Message: message}); err != nil {
+		log.Printf("Couldn't send status to %s on %v: %v\n", c.remoteType, c.channelID, err)
+	}
+}
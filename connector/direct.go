@@ -0,0 +1,57 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// A direct ssh channel (/create?type=ssh&direct=host:port) has no proxy
+// side: the connector dials the ssh server itself, if Options.DirectSSH
+// allows it. It starts as soon as its tunnel side connects.
+
+// Time allowed to connect to the ssh server of a direct channel.
+const directDialTimeout = 10 * time.Second
+
+// directAllowed checks the target of a direct channel, answering with an
+// error if it's refused. Channels without a target are always allowed.
+func (h *Hub) directAllowed(w http.ResponseWriter, kind, agent, target string) bool {
+	if len(target) == 0 {
+		return true
+	}
+	if kind != "ssh" {
+		http.Error(w, "only ssh channels can be direct", http.StatusBadRequest)
+		return false
+	}
+	if len(agent) > 0 {
+		http.Error(w, "a direct channel has no agent", http.StatusBadRequest)
+		return false
+	}
+	policy := h.options().DirectSSH
+	if policy == nil {
+		http.Error(w, "direct ssh channels are disabled", http.StatusForbidden)
+		return false
+	}
+	if _, _, err := policy.Resolve(target); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// dialDirect connects to target, checking it against the policy again: a
+// host name is dialed by the address it resolves to now.
+func dialDirect(h *Hub, target string) (net.Conn, error) {
+	policy := h.options().DirectSSH
+	if policy == nil {
+		return nil, errors.New("direct ssh channels are disabled")
+	}
+	network, address, err := policy.Resolve(target)
+	if err != nil {
+		return nil, err
+	}
+	return net.DialTimeout(network, address, directDialTimeout)
+}
@@ -0,0 +1,54 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDirectAllowed(t *testing.T) {
+	enabled, err := NewHub(&Options{DirectSSH: testPolicy(t, "10.0.0.0/24:22")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	disabled, err := NewHub(&Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name                string
+		hub                 *Hub
+		kind, agent, target string
+		want                int // 0 if allowed
+	}{
+		{"no target", disabled, "ssh", "db", "", 0},
+		{"allowed", enabled, "ssh", "", "10.0.0.9:22", 0},
+		{"not ssh", enabled, "tunnel", "", "10.0.0.9:22", http.StatusBadRequest},
+		{"with an agent", enabled, "ssh", "db", "10.0.0.9:22", http.StatusBadRequest},
+		{"disabled", disabled, "ssh", "", "10.0.0.9:22", http.StatusForbidden},
+		{"other address", enabled, "ssh", "", "10.0.1.9:22", http.StatusForbidden},
+		{"other port", enabled, "ssh", "", "10.0.0.9:2222", http.StatusForbidden},
+		{"no port", enabled, "ssh", "", "10.0.0.9", http.StatusForbidden},
+	} {
+		w := httptest.NewRecorder()
+		allowed := test.hub.directAllowed(w, test.kind, test.agent, test.target)
+		if allowed != (test.want == 0) || !allowed && w.Code != test.want {
+			t.Errorf("%s: allowed %v with %d, want %d", test.name, allowed, w.Code, test.want)
+		}
+	}
+}
+
+func TestCreateDirectRefused(t *testing.T) {
+	_, srv := testConnector(t, &Options{DirectSSH: testPolicy(t, "10.0.0.0/24:22")})
+	resp, err := http.Post(srv.URL+"/create?type=ssh&direct=10.0.1.9:22", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got %s, want 403", resp.Status)
+	}
+}
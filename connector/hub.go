@@ -0,0 +1,528 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+// Package connector is wwsconnector as a library, to embed the connector in
+// another server:
+//
+//	hub, err := connector.NewHub(&connector.Options{CreateRate: 30})
+//	mux.Handle("/wws/", http.StripPrefix("/wws", hub.Handler()))
+//
+// Channels created on /create?type=<type> are relayed by the handler
+// registered for their type with RegisterType; "tunnel" and "ssh" are
+// built-in.
+package connector
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/cors"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// Time allowed to write a message to the peer.
+	writeWait = 10 * time.Second
+
+	// Send pings to peer with this period. Must be less than pongWait.
+	pingPeriod = (writeWait * 5) / 10
+
+	// How often channel transfer rates are sampled.
+	ratePeriod = 5 * time.Second
+)
+
+type Hub struct {
+	channels       map[uuid.UUID]*Channel
+	createChannel  chan *Channel
+	registerClient chan *Client
+	watch          chan *Client
+	disconnected   chan *Client
+	listChannels   chan chan []channelInfo
+	agents         map[string]*agent
+	registerAgent  chan *agent
+	agentGone      chan *agent
+	agentChannel   chan agentRequest
+	listAgents     chan chan []agentInfo
+	limiter        *rate.Limiter            //shared by all channels, nil when unlimited
+	identities     map[string]*rate.Limiter //by client IP and agent, see ratelimit.go
+	guard          *guard
+	trusted        []*net.IPNet
+	webhooks       *notifier //nil when there are no webhooks
+	upgrader       websocket.Upgrader
+	draining       int32 //set atomically once we're shutting down
+	drain          chan struct{}
+	drained        chan struct{} //closed once draining and no channel is left
+	closeAll       chan chan struct{}
+
+	optsMu  sync.RWMutex
+	opts    Options
+	typesMu sync.RWMutex
+	types   map[string]ChannelHandler
+}
+
+// A ChannelHandler relays a channel once both its sides are connected. The
+// channel is torn down when it returns; SetCloseStatus on the side that
+// ended it tells the other side why.
+type ChannelHandler func(*Channel)
+
+type Channel struct {
+	proxy      *Client //the proxy is on the network that we can't reach
+	tunnel     *Client //the tunnel typically runs on our local computer
+	id         uuid.UUID
+	kind       string
+	created    time.Time
+	creator    string           //IP that created the channel
+	agent      string           //agent asked to connect the proxy side, if any
+	direct     string           //ssh server the connector dials itself, see direct.go
+	next       *nextHop         //connector a chained channel goes through, see chain.go
+	watchers   map[*Client]bool //of an ssh session, see watch.go
+	join       chan *Client     //hands new watchers to the session
+	hub        *Hub
+	handler    ChannelHandler
+	fromProxy  meter
+	fromTunnel meter
+}
+
+func (c *Channel) ID() string {
+	return c.id.String()
+}
+
+func (c *Channel) Type() string {
+	return c.kind
+}
+
+func (c *Channel) waitingFor() string {
+	if len(c.agent) > 0 {
+		return "waiting for agent " + c.agent
+	}
+	return "waiting for the proxy"
+}
+
+// started reports whether the channel has the sides it needs, a direct
+// channel only has its tunnel side.
+func (c *Channel) started() bool {
+	return c.tunnel != nil && (c.proxy != nil || len(c.direct) > 0)
+}
+
+// Proxy is the side on the network we can't reach, nil for a direct
+// channel.
+func (c *Channel) Proxy() *Client {
+	return c.proxy
+}
+
+// Tunnel is the side that asked for the channel, typically on our own
+// computer or a browser.
+func (c *Channel) Tunnel() *Client {
+	return c.tunnel
+}
+
+// NewHub starts a connector. Serve it with Handler.
+func NewHub(opts *Options) (*Hub, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	h := &Hub{
+		channels:       make(map[uuid.UUID]*Channel),
+		createChannel:  make(chan *Channel),
+		registerClient: make(chan *Client),
+		watch:          make(chan *Client),
+		disconnected:   make(chan *Client),
+		listChannels:   make(chan chan []channelInfo),
+		agents:         make(map[string]*agent),
+		registerAgent:  make(chan *agent),
+		agentGone:      make(chan *agent),
+		agentChannel:   make(chan agentRequest),
+		listAgents:     make(chan chan []agentInfo),
+		limiter:        newLimiter(opts.GlobalRate),
+		identities:     make(map[string]*rate.Limiter),
+		drain:          make(chan struct{}),
+		drained:        make(chan struct{}),
+		closeAll:       make(chan chan struct{}),
+		opts:           *opts,
+		types: map[string]ChannelHandler{
+			"tunnel": Passthrough,
+			"ssh":    sshShell,
+		},
+	}
+	h.guard = newGuard(h.options)
+	h.trusted, _ = parseNets(opts.TrustedProxies)
+	if len(opts.Webhooks) > 0 {
+		queueLen := opts.WebhookQueue
+		if queueLen == 0 {
+			queueLen = 1000
+		}
+		h.webhooks = newNotifier(opts.Webhooks, opts.WebhookSecret, queueLen, opts.WebhookRetries)
+	}
+	h.upgrader = websocket.Upgrader{
+		ReadBufferSize:    1024 * 128,
+		WriteBufferSize:   1024 * 128,
+		CheckOrigin:       h.originAllowed,
+		EnableCompression: opts.Compress,
+	}
+
+	go h.handleMessages()
+	return h, nil
+}
+
+// RegisterType makes /create?type=name create channels relayed by handler,
+// replacing any previous handler for that type.
+func (h *Hub) RegisterType(name string, handler ChannelHandler) {
+	h.typesMu.Lock()
+	h.types[name] = handler
+	h.typesMu.Unlock()
+}
+
+func (h *Hub) channelType(name string) ChannelHandler {
+	h.typesMu.RLock()
+	defer h.typesMu.RUnlock()
+	return h.types[name]
+}
+
+// Handler serves the connector's routes: /create, /csrf, /health, the
+// websockets under /ws and, if enabled, the web terminal under /terminal/
+// with /ssh/<agent> and /ssh-direct/<host:port> to open a session in it.
+func (h *Hub) Handler() http.Handler {
+	router := httprouter.New()
+	if notFound := h.options().NotFound; notFound != nil {
+		router.NotFound = notFound
+	}
+
+	router.GET("/csrf", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		issueCSRF(w, r)
+	})
+	router.POST("/create", guarded(h.guard.limitCreate, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if !h.csrfOK(r) {
+			http.Error(w, "cross-site request refused", http.StatusForbidden)
+			return
+		}
+		if h.isDraining() {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		channelHandlerType := r.URL.Query().Get("type")
+		if len(channelHandlerType) == 0 {
+			channelHandlerType = "tunnel"
+		}
+		agent, direct, via := r.URL.Query().Get("agent"), r.URL.Query().Get("direct"), r.URL.Query().Get("via")
+		if len(via) > 0 {
+			// the type, agent and direct= are for the last hop to check
+			if !h.authorized(w, r, Request{Op: OpCreate, Type: channelHandlerType, Agent: agent, Target: direct, Via: via}) {
+				return
+			}
+			log.Printf("Asked to create channel of type %s via %s", channelHandlerType, via)
+			createChained(h, w, r, channelHandlerType, via)
+			return
+		}
+		channelHandler := h.channelType(channelHandlerType)
+		if channelHandler == nil {
+			http.Error(w, "unknown channel type", http.StatusBadRequest)
+			return
+		}
+		if !h.directAllowed(w, channelHandlerType, agent, direct) {
+			return
+		}
+		if !h.authorized(w, r, Request{Op: OpCreate, Type: channelHandlerType, Agent: agent, Target: direct}) {
+			return
+		}
+		log.Println("Asked to create channel of type", channelHandlerType)
+		createChannel(h, w, r, p, channelHandlerType, channelHandler)
+	}))
+
+	router.GET("/ws/proxy/:id", guarded(h.guard.limitUpgrade, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if !h.authorized(w, r, Request{Op: OpProxy, Channel: p.ByName("id")}) {
+			return
+		}
+		id, _ := uuid.Parse(p.ByName("id"))
+		setRemote(h, w, r, id, "proxy", r.URL.Query())
+	}))
+	router.GET("/ws/tunnel/:id", guarded(h.guard.limitUpgrade, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if !h.authorized(w, r, Request{Op: OpTunnel, Channel: p.ByName("id")}) {
+			return
+		}
+		id, _ := uuid.Parse(p.ByName("id"))
+		setRemote(h, w, r, id, "tunnel", r.URL.Query())
+	}))
+	router.GET("/ws/watch/:id", guarded(h.guard.limitUpgrade, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if !h.authorized(w, r, Request{Op: OpWatch, Channel: p.ByName("id")}) {
+			return
+		}
+		id, _ := uuid.Parse(p.ByName("id"))
+		serveWatcher(h, w, r, id)
+	}))
+	router.GET("/ws/agent/:name", guarded(h.guard.limitUpgrade, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if h.isDraining() {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		if !h.authorized(w, r, Request{Op: OpAgent, Agent: p.ByName("name")}) {
+			return
+		}
+		serveAgent(h, w, r, p.ByName("name"))
+	}))
+	router.GET("/health", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		w.Write([]byte("ok"))
+	})
+	if h.options().Terminal {
+		router.Handler("GET", "/terminal/*filepath", terminalHandler())
+		router.GET("/ssh/:agent", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			sshLink(w, r, p.ByName("agent"), "")
+		})
+		router.GET("/ssh-direct/:target", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+			sshLink(w, r, "", p.ByName("target"))
+		})
+	}
+
+	origins := h.options().AllowedOrigins
+	if len(origins) == 0 {
+		return h.forwarded(router)
+	}
+
+	// Add CORS support (Cross Origin Resource Sharing). Pages of any origin
+	// ("*") don't get the cookies, the CSRF token included.
+	c := cors.New(cors.Options{
+		AllowedOrigins:   origins,
+		AllowedMethods:   []string{"GET", "POST"},
+		AllowedHeaders:   []string{csrfHeader},
+		AllowCredentials: !anyOrigin(origins),
+	})
+	return h.forwarded(c.Handler(router))
+}
+
+// authorized asks the Authorize hook, answering with a 403 if it refuses.
+func (h *Hub) authorized(w http.ResponseWriter, r *http.Request, req Request) bool {
+	authorize := h.options().Authorize
+	if authorize == nil {
+		return true
+	}
+	if err := authorize(r, req); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (h *Hub) setClient(client *Client) {
+	if channel, ok := h.channels[client.channelID]; ok {
+		if client.remoteType == "tunnel" {
+			channel.tunnel = client
+			client.meter = &channel.fromTunnel
+		} else if client.remoteType == "proxy" {
+			if len(channel.direct) > 0 || (channel.next != nil && !client.hop) {
+				log.Printf("Refusing proxy from %s for channel ID %v, the connector is its proxy\n", client.addr, client.channelID.String())
+				go client.CloseWith(closeChannelUnknown, "the connector is this channel's proxy")
+				return
+			}
+			channel.proxy = client
+			client.meter = &channel.fromProxy
+		}
+		client.limiter = newLimiter(h.options().ChannelRate)
+		client.identity[0] = h.identityLimiter(ipIdentity(client))
+		client.identity[1] = h.identityLimiter(agentIdentity(channel))
+		h.notify(attachedEvent(channel, client))
+
+		if h.isDraining() && !channel.started() {
+			// the other side would wait for a channel that will never start
+			log.Printf("Draining, turning away %s for channel ID: %v", client.remoteType, client.channelID.String())
+			go client.CloseWith(websocket.CloseGoingAway, goingAwayReason)
+		} else if channel.started() && channel.proxy == nil {
+			log.Printf("Got the tunnel side of direct channel ID: %v", client.channelID.String())
+			h.notify(channelEvent(EventStarted, channel))
+			go runHandler(channel, nil, channel.tunnel)
+		} else if channel.started() {
+			log.Printf("Got both sides for channel ID: %v", client.channelID.String())
+			channel.tunnel.otherSide = channel.proxy
+			channel.proxy.otherSide = channel.tunnel
+			log.Println("Launching channel handler")
+			h.notify(channelEvent(EventStarted, channel))
+			go runHandler(channel, channel.proxy, channel.tunnel)
+		} else if channel.next != nil && client == channel.tunnel {
+			go dialHop(h, channel.id, channel.next, client)
+		} else if channel.proxy == nil && channel.kind == "ssh" {
+			go sendStatus(client, channel.waitingFor())
+		}
+	} else if client.hop {
+		// the chained channel went away while we were connecting
+		go client.CloseWith(closeChannelUnknown, "channel closed")
+	} else {
+		log.Printf("Registering %s from %s failed for channel ID %v, channel ID unknown\n", client.remoteType, client.addr, client.channelID.String())
+		h.guard.unknownChannel(client.addr)
+		h.guard.tarTrap(client)
+	}
+}
+
+// runHandler tears the channel down once its handler returns, if it didn't
+// already, on behalf of the side with a close status. A direct channel has
+// no proxy, its tunnel side gets its own status.
+func runHandler(channel *Channel, proxy, tunnel *Client) {
+	channel.handler(channel)
+	if proxy == nil {
+		tunnel.CloseWith(tunnel.closedWith())
+		channel.hub.disconnected <- tunnel
+		return
+	}
+	ended := proxy
+	if !proxy.hasCloseStatus() && tunnel.hasCloseStatus() {
+		ended = tunnel
+	}
+	// a handler that didn't say otherwise ended normally
+	ended.SetCloseStatus(websocket.CloseNormalClosure, "")
+	ended.CloseWith(websocket.CloseNormalClosure, "")
+	channel.hub.disconnected <- ended
+}
+
+// addChannel must only be called from the hub loop.
+func (h *Hub) addChannel(channel *Channel) {
+	log.Printf("Creating new channel ID: %v", channel.id.String())
+	h.channels[channel.id] = channel
+	h.notify(createdEvent(channel))
+}
+
+func (h *Hub) handleMessages() {
+	log.Println("Waiting for messages on channels")
+	ticker := time.NewTicker(ratePeriod)
+	for {
+		select {
+		case <-ticker.C:
+			for _, channel := range h.channels {
+				channel.fromProxy.sample(ratePeriod)
+				channel.fromTunnel.sample(ratePeriod)
+			}
+			h.forgetIdentities()
+
+		case reply := <-h.listChannels:
+			reply <- h.channelInfos()
+
+		case reply := <-h.listAgents:
+			reply <- h.agentInfos()
+
+		case <-h.drain:
+			h.turnAwayIdle()
+			h.checkDrained()
+
+		case done := <-h.closeAll:
+			h.closeChannels()
+			h.closeAgents()
+			close(done)
+
+		case channel := <-h.createChannel:
+			h.addChannel(channel)
+
+		case req := <-h.agentChannel:
+			h.openAgentChannel(req)
+
+		case a := <-h.registerAgent:
+			h.setAgent(a)
+
+		case a := <-h.agentGone:
+			h.removeAgent(a)
+
+		//the proxy is on the network that we can't reach
+		case client := <-h.registerClient:
+			log.Printf("Registering %s for channel ID: %v", client.remoteType, client.channelID.String())
+			h.setClient(client)
+
+		case client := <-h.watch:
+			h.addWatcher(client)
+
+		//one of the sides disconnected, destroy the channel, telling the
+		//other side why
+		case client := <-h.disconnected:
+			if client.remoteType == "watcher" {
+				// watchers come and go, the channel stays
+				h.removeWatcher(client)
+				break
+			}
+			// a side that was turned away has nothing to tear down
+			if channel, ok := h.channels[client.channelID]; ok && (client == channel.proxy || client == channel.tunnel) {
+				log.Printf("Destroying tunnel for channel ID: %v", channel.id.String())
+				code, reason := client.closedWith()
+				for _, c := range []*Client{channel.proxy, channel.tunnel} {
+					if c == nil {
+						continue
+					}
+					if c == client {
+						c.ws.Close()
+					} else {
+						go c.CloseWith(code, reason)
+					}
+					c.otherSide = nil
+				}
+				h.closeWatchers(channel, code, reason)
+				// not clearing the sides: the handler may still be reading them
+				delete(h.channels, channel.id)
+				h.notify(destroyedEvent(channel, client.remoteType, code, reason))
+			}
+			h.checkDrained()
+		}
+	}
+}
+
+func setRemote(hub *Hub, w http.ResponseWriter, r *http.Request, channelID uuid.UUID, remoteType string, params map[string][]string) {
+	ws, err := hub.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Print("upgrade:", err)
+		return
+	}
+	defer ws.Close()
+
+	client := &Client{hub: hub, ws: ws, addr: remoteIP(r), channelID: channelID, params: params, remoteType: remoteType}
+	hub.registerClient <- client
+	keepalive(client)
+}
+
+func keepalive(client *Client) {
+	defer func() {
+		client.hub.disconnected <- client
+		if r := recover(); r != nil {
+			log.Printf("error in keepalive for %s on %s: %v", client.remoteType, client.channelID, r)
+		}
+	}()
+
+	ticker := time.NewTicker(pingPeriod)
+	for {
+		select {
+		case <-ticker.C:
+			if err := client.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait)); err != nil {
+				client.SetCloseStatus(closeTimeout, "peer timed out")
+				panic(err)
+			}
+		}
+	}
+}
+
+func createChannel(hub *Hub, w http.ResponseWriter, r *http.Request, p httprouter.Params, kind string, channelHandler ChannelHandler) {
+	id, err := newChannel(hub, r, &Channel{kind: kind, handler: channelHandler, agent: r.URL.Query().Get("agent"), direct: r.URL.Query().Get("direct")})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Write([]byte(id.String()))
+}
+
+// newChannel adds channel, of which only the kind, handler and how it's
+// reached (agent, direct or next) are set, handing it to its agent if it has
+// one. It fails if the agent is offline.
+func newChannel(hub *Hub, r *http.Request, channel *Channel) (uuid.UUID, error) {
+	log.Printf("Creating new channel")
+	channel.hub, channel.id, channel.created, channel.creator = hub, uuid.New(), time.Now(), remoteIP(r)
+	channel.watchers, channel.join = make(map[*Client]bool), make(chan *Client, maxWatchers)
+	if len(channel.agent) > 0 {
+		reply := make(chan error, 1)
+		hub.agentChannel <- agentRequest{name: channel.agent, channel: channel, reply: reply}
+		if err := <-reply; err != nil {
+			return channel.id, err
+		}
+	} else {
+		hub.createChannel <- channel
+	}
+	return channel.id, nil
+}
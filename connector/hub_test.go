@@ -0,0 +1,209 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testConnector serves a hub, closed with the test.
+func testConnector(t testing.TB, opts *Options) (*Hub, *httptest.Server) {
+	t.Helper()
+	h, err := NewHub(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(h.Handler())
+	t.Cleanup(srv.Close)
+	return h, srv
+}
+
+// testCreate creates a channel, with the query of /create.
+func testCreate(t testing.TB, srv *httptest.Server, query string) string {
+	t.Helper()
+	resp, err := http.Post(srv.URL+"/create?"+query, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	buf, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("create: %s: %s", resp.Status, buf)
+	}
+	return string(buf)
+}
+
+// testDial connects to a websocket of the connector, like "tunnel/<id>".
+func testDial(t testing.TB, srv *httptest.Server, path string) *websocket.Conn {
+	t.Helper()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws/"+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+// testRead reads a message, failing the test on error.
+func testRead(t testing.TB, ws *websocket.Conn) (int, []byte) {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	messageType, buf, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return messageType, buf
+}
+
+func TestRelay(t *testing.T) {
+	_, srv := testConnector(t, &Options{})
+	id := testCreate(t, srv, "")
+	tunnel := testDial(t, srv, "tunnel/"+id)
+	proxy := testDial(t, srv, "proxy/"+id)
+
+	tunnel.WriteMessage(websocket.BinaryMessage, []byte("to the proxy"))
+	if messageType, buf := testRead(t, proxy); messageType != websocket.BinaryMessage || string(buf) != "to the proxy" {
+		t.Errorf("proxy got %d %q", messageType, buf)
+	}
+	proxy.WriteMessage(websocket.TextMessage, []byte("to the tunnel"))
+	if messageType, buf := testRead(t, tunnel); messageType != websocket.TextMessage || string(buf) != "to the tunnel" {
+		t.Errorf("tunnel got %d %q", messageType, buf)
+	}
+
+	// larger than a relay buffer, streamed through in several
+	big := make([]byte, 3*relayBufSize+5)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	tunnel.WriteMessage(websocket.BinaryMessage, big)
+	if _, buf := testRead(t, proxy); string(buf) != string(big) {
+		t.Errorf("proxy got %d bytes of %d", len(buf), len(big))
+	}
+
+	// closing a side closes the other with the same code
+	tunnel.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4321, "bye"))
+	if code := testCloseCode(t, proxy); code != 4321 {
+		t.Errorf("proxy closed with %d, want 4321", code)
+	}
+}
+
+func TestRegisterType(t *testing.T) {
+	h, srv := testConnector(t, &Options{})
+	h.RegisterType("greet", func(channel *Channel) {
+		conn := NewConn(channel.Tunnel())
+		defer conn.Close()
+		conn.Write([]byte("hello " + channel.Type()))
+	})
+
+	id := testCreate(t, srv, "type=greet")
+	tunnel := testDial(t, srv, "tunnel/"+id)
+	testDial(t, srv, "proxy/"+id)
+	if _, buf := testRead(t, tunnel); string(buf) != "hello greet" {
+		t.Errorf("got %q", buf)
+	}
+	// torn down once the handler returns
+	if code := testCloseCode(t, tunnel); code != websocket.CloseNormalClosure {
+		t.Errorf("closed with %d", code)
+	}
+
+	resp, err := http.Post(srv.URL+"/create?type=nope", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown type: got %s", resp.Status)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	var mu sync.Mutex
+	var asked []Request
+	_, srv := testConnector(t, &Options{
+		Authorize: func(r *http.Request, req Request) error {
+			mu.Lock()
+			asked = append(asked, req)
+			mu.Unlock()
+			if req.Op == OpProxy || req.Type == "ssh" {
+				return errors.New("not you")
+			}
+			return nil
+		},
+	})
+
+	id := testCreate(t, srv, "")
+	resp, err := http.Post(srv.URL+"/create?type=ssh", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("refused create: got %s", resp.Status)
+	}
+
+	testDial(t, srv, "tunnel/"+id)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws/proxy/" + id
+	if _, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("refused proxy: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []Request{
+		{Op: OpCreate, Type: "tunnel"},
+		{Op: OpCreate, Type: "ssh"},
+		{Op: OpTunnel, Channel: id},
+		{Op: OpProxy, Channel: id},
+	}
+	if len(asked) != len(want) {
+		t.Fatalf("asked %v, want %v", asked, want)
+	}
+	for i := range want {
+		if asked[i] != want[i] {
+			t.Errorf("asked %+v, want %+v", asked[i], want[i])
+		}
+	}
+}
+
+func TestOnEvent(t *testing.T) {
+	events := make(chan Event, 16)
+	_, srv := testConnector(t, &Options{OnEvent: func(e Event) { events <- e }})
+
+	id := testCreate(t, srv, "")
+	tunnel := testDial(t, srv, "tunnel/"+id)
+	testDial(t, srv, "proxy/"+id)
+	tunnel.WriteMessage(websocket.BinaryMessage, []byte("12345"))
+	time.Sleep(50 * time.Millisecond)
+	tunnel.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+
+	var got []string
+	for e := range events {
+		if e.Channel != id || len(e.ID) == 0 {
+			t.Errorf("event %+v", e)
+		}
+		name := e.Event
+		if e.Event == EventAttached {
+			name += " " + e.Side
+		}
+		got = append(got, name)
+		if e.Event == EventDestroyed {
+			if e.Side != "tunnel" || e.Bytes == nil || e.Bytes.FromTunnel != 5 {
+				t.Errorf("destroyed %+v, bytes %+v", e, e.Bytes)
+			}
+			break
+		}
+	}
+	want := []string{EventCreated, EventAttached + " tunnel", EventAttached + " proxy", EventStarted, EventDestroyed}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("events %v, want %v", got, want)
+	}
+}
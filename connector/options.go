@@ -0,0 +1,155 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/wegel/wwscc/wwsclient"
+)
+
+// Options configure a Hub. The zero value is a connector without any limit,
+// webhook or hook.
+type Options struct {
+	// Origins allowed for CORS and browser websockets, besides the
+	// connector's own. "*" allows any.
+	AllowedOrigins []string
+	// Accept per-message compression from clients that ask for it, for
+	// messages of at least CompressThreshold bytes.
+	Compress          bool
+	CompressThreshold int
+	// Max bytes/s relayed in each direction of a channel, and across all
+	// channels (0 for unlimited).
+	ChannelRate int
+	GlobalRate  int
+	// Max bytes/s relayed from a single client IP, and for a single agent's
+	// channels, across all their channels (0 for unlimited).
+	IdentityRate int
+	// Max channels created and websocket connections per minute from a
+	// single IP (0 for unlimited).
+	CreateRate  int
+	UpgradeRate int
+	// Ban an IP for BanTime after BanAfter attempts to join unknown channels
+	// within BanTime (0 to never ban).
+	BanAfter int
+	BanTime  time.Duration
+	// Hold connections to unknown channels open this long before closing
+	// them, TarTrapMax at most at once (100 if 0).
+	TarTrap    time.Duration
+	TarTrapMax int
+	// IPs and CIDRs of the reverse proxies in front of the connector, whose
+	// X-Forwarded-For or X-Real-IP tells the client IP.
+	TrustedProxies []string
+
+	// URLs to POST channel events to, signed with WebhookSecret if set.
+	// Each URL queues up to WebhookQueue events (1000 if 0), and failed
+	// deliveries are retried WebhookRetries times.
+	Webhooks       []string
+	WebhookSecret  []byte
+	WebhookQueue   int
+	WebhookRetries int
+
+	// Serve the web terminal under /terminal/.
+	Terminal bool
+	// Servers ssh channels may connect to from the connector itself, without
+	// a proxy (/create?type=ssh&direct=host:port). Nil disables direct
+	// channels.
+	DirectSSH *wwsclient.Policy
+	// Other connectors channels can be chained through, by name
+	// (/create?via=name[,name...]).
+	Hops map[string]Hop
+	// Serves the requests not for the connector, 404 if nil.
+	NotFound http.Handler
+	// Called before creating a channel, connecting one of its sides or a
+	// watcher, or registering an agent. An error refuses the request with a
+	// 403 and the error's message.
+	Authorize func(r *http.Request, req Request) error
+	// Called with every channel event, from the hub loop: it must not
+	// block.
+	OnEvent func(Event)
+}
+
+// What Authorize is asked about.
+type Request struct {
+	Op      string // one of the Op constants
+	Type    string // OpCreate: the channel type
+	Channel string // OpProxy, OpTunnel and OpWatch: the channel ID
+	Agent   string // OpAgent, or OpCreate for an agent
+	Target  string // OpCreate: the ssh server of a direct channel
+	Via     string // OpCreate: the hops of a chained channel
+}
+
+const (
+	OpCreate = "create"
+	OpProxy  = "proxy"
+	OpTunnel = "tunnel"
+	OpAgent  = "agent"
+	OpWatch  = "watch"
+)
+
+// Validate checks for settings out of range.
+func (opts *Options) Validate() error {
+	for name, value := range map[string]int{
+		"CompressThreshold": opts.CompressThreshold,
+		"ChannelRate":       opts.ChannelRate,
+		"GlobalRate":        opts.GlobalRate,
+		"IdentityRate":      opts.IdentityRate,
+		"CreateRate":        opts.CreateRate,
+		"UpgradeRate":       opts.UpgradeRate,
+		"BanAfter":          opts.BanAfter,
+		"TarTrapMax":        opts.TarTrapMax,
+		"WebhookQueue":      opts.WebhookQueue,
+		"WebhookRetries":    opts.WebhookRetries,
+	} {
+		if value < 0 {
+			return fmt.Errorf("%s can't be negative", name)
+		}
+	}
+	for name, value := range map[string]time.Duration{
+		"BanTime": opts.BanTime,
+		"TarTrap": opts.TarTrap,
+	} {
+		if value < 0 {
+			return fmt.Errorf("%s can't be negative", name)
+		}
+	}
+	if _, err := parseNets(opts.TrustedProxies); err != nil {
+		return fmt.Errorf("TrustedProxies: %v", err)
+	}
+	return nil
+}
+
+// options returns the current options, Reload may change them.
+func (h *Hub) options() Options {
+	h.optsMu.RLock()
+	defer h.optsMu.RUnlock()
+	return h.opts
+}
+
+// Reload applies the settings of opts that can change while running:
+// CompressThreshold, ChannelRate and IdentityRate (for the channels created
+// afterwards, or the identities without any channel left), CreateRate,
+// UpgradeRate, BanAfter, BanTime, TarTrap and TarTrapMax. The others are
+// ignored.
+func (h *Hub) Reload(opts *Options) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	h.optsMu.Lock()
+	h.opts.CompressThreshold = opts.CompressThreshold
+	h.opts.ChannelRate = opts.ChannelRate
+	h.opts.IdentityRate = opts.IdentityRate
+	h.opts.CreateRate = opts.CreateRate
+	h.opts.UpgradeRate = opts.UpgradeRate
+	h.opts.BanAfter = opts.BanAfter
+	h.opts.BanTime = opts.BanTime
+	h.opts.TarTrap = opts.TarTrap
+	h.opts.TarTrapMax = opts.TarTrapMax
+	h.optsMu.Unlock()
+
+	h.guard.updateLimits()
+	return nil
+}
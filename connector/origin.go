@@ -0,0 +1,94 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Browsers attach a logged-in operator's cookies and network access to
+// requests made by any page they visit, so requests coming from a browser
+// must prove they come from a page we trust: websocket upgrades and POSTs
+// must carry an allowed Origin (the connector's own, or one listed in
+// AllowedOrigins), and POSTs also need the CSRF token handed out by /csrf,
+// echoed in a header. Non-browser clients (wwscat, curl) send neither an
+// Origin nor cookies and are let through.
+//
+// GET /ssh/<agent> is meant to be linked to, so it only sends the browser to
+// the terminal page, which creates the channel with a POST.
+
+const (
+	csrfCookie = "wws_csrf"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// originAllowed is the upgrader's CheckOrigin.
+func (h *Hub) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range h.options().AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyOrigin(origins []string) bool {
+	for _, origin := range origins {
+		if origin == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func fromBrowser(r *http.Request) bool {
+	return len(r.Header.Get("Origin")) > 0 || len(r.Header.Get("Sec-Fetch-Mode")) > 0 || len(r.Header.Get("Cookie")) > 0
+}
+
+// csrfOK checks a state changing request.
+func (h *Hub) csrfOK(r *http.Request) bool {
+	if !fromBrowser(r) {
+		return true
+	}
+	if !h.originAllowed(r) {
+		return false
+	}
+	cookie, err := r.Cookie(csrfCookie)
+	token := r.Header.Get(csrfHeader)
+	return err == nil && len(token) > 0 && subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(token)) == 1
+}
+
+// issueCSRF sets a new CSRF cookie, and writes the token pages must echo in
+// the X-CSRF-Token header.
+func issueCSRF(w http.ResponseWriter, r *http.Request) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	token := hex.EncodeToString(buf)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(token))
+}
@@ -0,0 +1,113 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// testCSRF gets a CSRF token and its cookie.
+func testCSRF(t *testing.T, srv *httptest.Server) (string, *http.Cookie) {
+	t.Helper()
+	resp, err := http.Get(srv.URL + "/csrf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	token, _ := ioutil.ReadAll(resp.Body)
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == csrfCookie {
+			return string(token), cookie
+		}
+	}
+	t.Fatal("no CSRF cookie")
+	return "", nil
+}
+
+func TestUpgradeOrigin(t *testing.T) {
+	_, srv := testConnector(t, &Options{AllowedOrigins: []string{"https://term.example.com"}})
+	id := testCreate(t, srv, "")
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws/tunnel/" + id
+
+	for origin, want := range map[string]int{
+		"https://evil.example.com": http.StatusForbidden,
+		"https://term.example.com": http.StatusSwitchingProtocols,
+		srv.URL:                    http.StatusSwitchingProtocols,
+	} {
+		ws, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {origin}})
+		if ws != nil {
+			ws.Close()
+		}
+		if resp == nil {
+			t.Fatalf("origin %s: %v", origin, err)
+		}
+		if resp.StatusCode != want {
+			t.Errorf("origin %s: got %s, want %d", origin, resp.Status, want)
+		}
+	}
+}
+
+func TestCreateCSRF(t *testing.T) {
+	_, srv := testConnector(t, &Options{AllowedOrigins: []string{"https://term.example.com"}})
+	token, cookie := testCSRF(t, srv)
+
+	for _, test := range []struct {
+		name, origin, token string
+		cookie              bool
+		want                int
+	}{
+		{"no browser headers", "", "", false, http.StatusOK},
+		{"same origin", srv.URL, token, true, http.StatusOK},
+		{"allowed origin", "https://term.example.com", token, true, http.StatusOK},
+		{"foreign origin", "https://evil.example.com", token, true, http.StatusForbidden},
+		{"missing token", srv.URL, "", true, http.StatusForbidden},
+		{"missing cookie", srv.URL, token, false, http.StatusForbidden},
+		{"mismatched token", srv.URL, strings.Repeat("0", len(token)), true, http.StatusForbidden},
+	} {
+		req, _ := http.NewRequest("POST", srv.URL+"/create", nil)
+		if len(test.origin) > 0 {
+			req.Header.Set("Origin", test.origin)
+		}
+		if len(test.token) > 0 {
+			req.Header.Set(csrfHeader, test.token)
+		}
+		if test.cookie {
+			req.AddCookie(cookie)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.want {
+			t.Errorf("%s: got %s, want %d", test.name, resp.Status, test.want)
+		}
+	}
+}
+
+func TestCORSAnyOriginWithoutCredentials(t *testing.T) {
+	for _, origins := range [][]string{{"*"}, {"https://term.example.com"}} {
+		_, srv := testConnector(t, &Options{AllowedOrigins: origins})
+		req, _ := http.NewRequest("GET", srv.URL+"/csrf", nil)
+		req.Header.Set("Origin", "https://term.example.com")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		credentials := resp.Header.Get("Access-Control-Allow-Credentials") == "true"
+		if credentials == anyOrigin(origins) {
+			t.Errorf("--cors %v: Access-Control-Allow-Credentials %v", origins, credentials)
+		}
+		if !anyOrigin(origins) && resp.Header.Get("Access-Control-Allow-Origin") != "https://term.example.com" {
+			t.Errorf("--cors %v: origin not allowed", origins)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package connector
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Each direction of a channel is a reader filling pooled buffers into a
+// bounded queue, and a writer draining that queue into the other side. Large
+// messages are streamed through in several buffers rather than read whole.
+// When the writer falls behind, the queue fills up and the reader stops
+// reading, which pushes back on the sender instead of growing our memory.
+const (
+	relayQueueLen = 16
+	relayBufSize  = 32 * 1024
+)
+
+var relayBufs = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, relayBufSize)
+		return &buf
+	},
+}
+
+// A frame is a piece of a websocket message.
+type frame struct {
+	msgType int
+	buf     *[]byte
+	n       int
+	first   bool
+	last    bool
+}
+
+func Passthrough(channel *Channel) {
+	go relay(channel, channel.proxy, channel.tunnel)
+	relay(channel, channel.tunnel, channel.proxy)
+}
+
+// relay copies messages from src to dst until either side fails.
+func relay(channel *Channel, src, dst *Client) {
+	defer func(remoteType string) {
+		src.hub.disconnected <- src
+		if r := recover(); r != nil {
+			log.Printf("Passthrough handled exception for %s: %v\n", remoteType, r)
+		}
+	}(src.remoteType)
+
+	queue := make(chan frame, relayQueueLen)
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		writeFrames(dst, queue, func(err error) {
+			log.Printf("%s write error on channel %v: %v\n", dst.remoteType, channel.id, err)
+			// unblocks readFrames, and gets the hub to tear down both sides
+			src.ws.Close()
+		})
+	}()
+
+	err := readFrames(src, queue)
+	close(queue)
+	// dst gets what src sent before closing (like an ssh session's exit
+	// status, through a chain), before the hub closes it; writes time out
+	<-written
+	if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway) {
+		log.Printf("%s read error on channel %v: %v\n", src.remoteType, channel.id, err)
+	}
+	src.SetCloseStatus(closeStatus(err))
+}
+
+func readFrames(src *Client, queue chan<- frame) error {
+	for {
+		msgType, r, err := src.NextReader()
+		if err != nil {
+			return err
+		}
+
+		for first := true; ; first = false {
+			buf := relayBufs.Get().(*[]byte)
+			n, err := io.ReadFull(r, *buf)
+			last := err == io.EOF || err == io.ErrUnexpectedEOF
+			if err != nil && !last {
+				relayBufs.Put(buf)
+				return err
+			}
+
+			src.account(n)
+			queue <- frame{msgType: msgType, buf: buf, n: n, first: first, last: last}
+			if last {
+				break
+			}
+		}
+	}
+}
+
+// writeFrames writes queued frames to dst until the queue is closed. On the
+// first write error it calls failed, then only drains the remaining frames so
+// that the reader is never left blocked on a full queue.
+func writeFrames(dst *Client, queue <-chan frame, failed func(error)) {
+	var w io.WriteCloser
+	var err error
+	for f := range queue {
+		if err == nil {
+			if err = writeFrame(dst, &w, f); err != nil {
+				failed(err)
+			}
+		}
+		relayBufs.Put(f.buf)
+	}
+}
+
+func writeFrame(dst *Client, w *io.WriteCloser, f frame) (err error) {
+	if err = dst.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+		return
+	}
+	if f.first {
+		// a message spanning several frames is large enough to be compressed.
+		// gorilla/websocket only hands us decompressed payloads, so messages
+		// are compressed again even when both sides negotiated the same
+		// settings; relaying the compressed frames as is would take our own
+		// framing.
+		dst.EnableWriteCompression(!f.last || f.n >= dst.hub.options().CompressThreshold)
+		if *w, err = dst.NextWriter(f.msgType); err != nil {
+			return
+		}
+	}
+	if _, err = (*w).Write((*f.buf)[:f.n]); err != nil {
+		return
+	}
+	if f.last {
+		err = (*w).Close()
+		*w = nil
+	}
+	return
+}
@@ -0,0 +1,39 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func benchmarkRelay(b *testing.B, size int) {
+	_, srv := testConnector(b, &Options{})
+	id := testCreate(b, srv, "")
+	tunnel := testDial(b, srv, "tunnel/"+id)
+	proxy := testDial(b, srv, "proxy/"+id)
+
+	msg := make([]byte, size)
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if err := tunnel.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := proxy.ReadMessage(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRelaySmall(b *testing.B) { benchmarkRelay(b, 1024) }
+
+// streamed through in several frames
+func BenchmarkRelayLarge(b *testing.B) { benchmarkRelay(b, 1024*1024) }
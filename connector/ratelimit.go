@@ -0,0 +1,119 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Largest amount of bytes we wait for at once, so that channels sharing the
+// global limiter take turns instead of one big message hogging it.
+const throttleChunk = 16 * 1024
+
+// meter counts the bytes read from one side of a channel.
+type meter struct {
+	total uint64  // updated atomically by the relaying goroutines
+	last  uint64  // total at the previous sample, owned by the hub loop
+	rate  float64 // bytes/s over the last sample period, owned by the hub loop
+}
+
+// newLimiter returns a token bucket letting bytesPerSec through, or nil (no
+// limit) when bytesPerSec is 0.
+func newLimiter(bytesPerSec int) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	burst := bytesPerSec
+	if burst < throttleChunk {
+		burst = throttleChunk
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), burst)
+}
+
+// throttle waits until n bytes may pass every (non-nil) limiter.
+func throttle(n int, limiters ...*rate.Limiter) {
+	for n > 0 {
+		chunk := n
+		if chunk > throttleChunk {
+			chunk = throttleChunk
+		}
+		for _, l := range limiters {
+			if l != nil {
+				l.WaitN(context.Background(), chunk)
+			}
+		}
+		n -= chunk
+	}
+}
+
+// account records n bytes read from this client, and waits until the
+// channel, identity and global rate limits let them through.
+func (c *Client) account(n int) {
+	if c.meter != nil {
+		atomic.AddUint64(&c.meter.total, uint64(n))
+	}
+	throttle(n, c.limiter, c.identity[0], c.identity[1], c.hub.limiter)
+}
+
+// sample updates the transfer rate, called every period from the hub loop.
+func (m *meter) sample(period time.Duration) {
+	total := atomic.LoadUint64(&m.total)
+	m.rate = float64(total-m.last) / period.Seconds()
+	m.last = total
+}
+
+// An identity (a client IP or an agent) shares a limiter across all its
+// channels, so that opening more of them doesn't get it more bandwidth. The
+// limiters are owned by the hub loop, and forgotten once no channel uses
+// them anymore.
+
+func ipIdentity(c *Client) string {
+	if c.hop {
+		// our own connection, to the next connector
+		return ""
+	}
+	return "ip " + c.addr
+}
+
+func agentIdentity(channel *Channel) string {
+	if len(channel.agent) == 0 {
+		return ""
+	}
+	return "agent " + channel.agent
+}
+
+// identityLimiter returns the limiter shared by identity, nil if it's empty
+// or there's no limit.
+func (h *Hub) identityLimiter(identity string) *rate.Limiter {
+	if len(identity) == 0 {
+		return nil
+	}
+	l, ok := h.identities[identity]
+	if !ok {
+		l = newLimiter(h.options().IdentityRate)
+		h.identities[identity] = l
+	}
+	return l
+}
+
+// forgetIdentities drops the limiters of the identities without a channel.
+func (h *Hub) forgetIdentities() {
+	inUse := make(map[string]bool)
+	for _, channel := range h.channels {
+		for _, c := range []*Client{channel.proxy, channel.tunnel} {
+			if c != nil {
+				inUse[ipIdentity(c)] = true
+				inUse[agentIdentity(channel)] = true
+			}
+		}
+	}
+	for identity := range h.identities {
+		if !inUse[identity] {
+			delete(h.identities, identity)
+		}
+	}
+}
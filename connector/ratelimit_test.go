@@ -0,0 +1,55 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestIdentityLimiters(t *testing.T) {
+	h, err := NewHub(&Options{IdentityRate: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attach := func(agent, addr string) *Client {
+		channel := &Channel{id: uuid.New(), kind: "tunnel", agent: agent, handler: Passthrough, hub: h}
+		h.channels[channel.id] = channel
+		client := &Client{hub: h, addr: addr, channelID: channel.id, remoteType: "tunnel"}
+		h.setClient(client)
+		return client
+	}
+
+	a := attach("", "10.0.0.1")
+	b := attach("office", "10.0.0.1")
+	c := attach("office", "10.0.0.2")
+	if a.identity[0] == nil || a.identity[0] != b.identity[0] {
+		t.Error("the channels of an IP don't share its limiter")
+	}
+	if b.identity[0] == c.identity[0] {
+		t.Error("two IPs share a limiter")
+	}
+	if a.identity[1] != nil || b.identity[1] == nil || b.identity[1] != c.identity[1] {
+		t.Error("the channels of an agent don't share its limiter")
+	}
+	if a.limiter != nil {
+		t.Error("got a channel limiter without a channel rate")
+	}
+
+	// gone with the last channel using them
+	for id, channel := range h.channels {
+		if channel.tunnel == a {
+			delete(h.channels, id)
+		}
+	}
+	h.forgetIdentities()
+	if len(h.identities) != 3 {
+		t.Errorf("%d identities left, want 3", len(h.identities))
+	}
+	h.channels = nil
+	h.forgetIdentities()
+	if len(h.identities) != 0 {
+		t.Errorf("%d identities left, want 0", len(h.identities))
+	}
+}
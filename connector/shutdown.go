@@ -0,0 +1,94 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// Sent with the close frame when we shut down, so that clients able to
+// reconnect know they should.
+const goingAwayReason = "going away, reconnect"
+
+// Shutdown stops accepting new channels, right away turns away clients
+// still waiting for their other side, and waits for active channels to end
+// until ctx is done. The channels left then are closed, and Shutdown returns
+// once the last webhook events are delivered or given up on.
+func (h *Hub) Shutdown(ctx context.Context) {
+	atomic.StoreInt32(&h.draining, 1)
+	h.drain <- struct{}{}
+
+	select {
+	case <-h.drained:
+		log.Println("All channels ended")
+	case <-ctx.Done():
+		log.Println("Closing remaining channels")
+	}
+
+	done := make(chan struct{})
+	h.closeAll <- done
+	<-done
+	h.guard.close()
+	h.webhooks.flush(writeWait)
+}
+
+func (h *Hub) isDraining() bool {
+	return atomic.LoadInt32(&h.draining) != 0
+}
+
+// turnAwayIdle forgets channels that haven't started, closing the side that
+// may be waiting on them. Must only be called from the hub loop.
+func (h *Hub) turnAwayIdle() {
+	for id, channel := range h.channels {
+		if channel.started() {
+			continue
+		}
+		for _, c := range []*Client{channel.proxy, channel.tunnel} {
+			if c != nil {
+				go c.CloseWith(websocket.CloseGoingAway, goingAwayReason)
+			}
+		}
+		delete(h.channels, id)
+		h.notify(destroyedEvent(channel, "", websocket.CloseGoingAway, goingAwayReason))
+	}
+}
+
+// checkDrained must only be called from the hub loop.
+func (h *Hub) checkDrained() {
+	if h.isDraining() && len(h.channels) == 0 {
+		select {
+		case <-h.drained:
+		default:
+			close(h.drained)
+		}
+	}
+}
+
+// closeChannels sends a going away close frame to every client left, and
+// returns once they're all closed. Must only be called from the hub loop.
+func (h *Hub) closeChannels() {
+	var wg sync.WaitGroup
+	for id, channel := range h.channels {
+		clients := []*Client{channel.proxy, channel.tunnel}
+		for c := range channel.watchers {
+			clients = append(clients, c)
+		}
+		for _, c := range clients {
+			if c != nil {
+				wg.Add(1)
+				go func(c *Client) {
+					c.CloseWith(websocket.CloseGoingAway, goingAwayReason)
+					wg.Done()
+				}(c)
+			}
+		}
+		delete(h.channels, id)
+		h.notify(destroyedEvent(channel, "", websocket.CloseGoingAway, goingAwayReason))
+	}
+	wg.Wait()
+}
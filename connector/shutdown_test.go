@@ -0,0 +1,101 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestShutdown(t *testing.T) {
+	h, srv := testConnector(t, &Options{})
+	running := testCreate(t, srv, "")
+	tunnel := testDial(t, srv, "tunnel/"+running)
+	proxy := testDial(t, srv, "proxy/"+running)
+	idle := testCreate(t, srv, "")
+	waiting := testDial(t, srv, "tunnel/"+idle)
+
+	const drainTime = 500 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), drainTime)
+	defer cancel()
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		h.Shutdown(ctx)
+		close(done)
+	}()
+
+	// the idle channel is turned away right away, not at the deadline
+	if code := testCloseCode(t, waiting); code != websocket.CloseGoingAway {
+		t.Errorf("idle channel closed with %d, want %d", code, websocket.CloseGoingAway)
+	}
+	if elapsed := time.Since(start); elapsed >= drainTime {
+		t.Errorf("idle channel closed after %v", elapsed)
+	}
+
+	// nothing new while draining
+	if status := testStatus(t, srv.URL); status != http.StatusServiceUnavailable {
+		t.Errorf("create got %d, want %d", status, http.StatusServiceUnavailable)
+	}
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws/agent/db", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("agent got %v, %v, want %d", resp, err, http.StatusServiceUnavailable)
+	}
+	late := testDial(t, srv, "proxy/"+idle)
+	if code := testCloseCode(t, late); code != closeChannelUnknown {
+		t.Errorf("joining the idle channel closed with %d, want %d", code, closeChannelUnknown)
+	}
+
+	// the running channel still works until the deadline
+	tunnel.WriteMessage(websocket.BinaryMessage, []byte("still here"))
+	if _, buf := testRead(t, proxy); string(buf) != "still here" {
+		t.Errorf("proxy got %q", buf)
+	}
+	select {
+	case <-done:
+		t.Fatal("Shutdown returned with a channel running")
+	default:
+	}
+
+	// then it's closed
+	for _, ws := range []*websocket.Conn{tunnel, proxy} {
+		if code := testCloseCode(t, ws); code != websocket.CloseGoingAway {
+			t.Errorf("running channel closed with %d, want %d", code, websocket.CloseGoingAway)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < drainTime {
+		t.Errorf("running channel closed after %v, before the deadline", elapsed)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown didn't return")
+	}
+}
+
+func TestShutdownDrained(t *testing.T) {
+	h, srv := testConnector(t, &Options{})
+	id := testCreate(t, srv, "")
+	tunnel := testDial(t, srv, "tunnel/"+id)
+	testDial(t, srv, "proxy/"+id)
+
+	done := make(chan struct{})
+	go func() {
+		h.Shutdown(context.Background())
+		close(done)
+	}()
+
+	// returns once the last channel ends, no deadline needed
+	time.Sleep(50 * time.Millisecond)
+	tunnel.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown still waiting with no channel left")
+	}
+}
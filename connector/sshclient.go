@@ -0,0 +1,276 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/ssh"
+)
+
+func getSupportedCiphers() []string {
+	config := &ssh.ClientConfig{}
+	config.SetDefaults()
+	for _, cipher := range []string{"aes128-cbc"} {
+		found := false
+		for _, defaultCipher := range config.Ciphers {
+			if cipher == defaultCipher {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			config.Ciphers = append(config.Ciphers, cipher)
+		}
+	}
+	return config.Ciphers
+}
+
+// pty follows the size of the terminal on the tunnel side, which may change
+// before the session starts (while typing the password).
+type pty struct {
+	mu         sync.Mutex
+	cols, rows int
+	session    *ssh.Session
+	shared     *share // told about new sizes, for the watchers
+}
+
+func (p *pty) resize(cols, rows int) {
+	if cols <= 0 || rows <= 0 {
+		return
+	}
+	p.mu.Lock()
+	p.cols, p.rows = cols, rows
+	if p.session != nil {
+		if err := p.session.WindowChange(rows, cols); err != nil {
+			log.Println("Window change failed:", err)
+		}
+	}
+	shared := p.shared
+	p.mu.Unlock()
+
+	// not under mu, the share asks for our size while holding its own lock
+	if shared != nil {
+		shared.resized(cols, rows)
+	}
+}
+
+func (p *pty) size() (cols, rows int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.cols, p.rows
+}
+
+func (p *pty) share(s *share) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.shared = s
+}
+
+func (p *pty) request(session *ssh.Session, modes ssh.TerminalModes) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.session = session
+	return session.RequestPty("xterm", p.rows, p.cols, modes)
+}
+
+// sshTransport remembers whether the connection to the ssh server failed,
+// before the ssh client closed it.
+type sshTransport struct {
+	net.Conn
+	closed int32 // atomic
+	failed int32 // atomic
+}
+
+func (t *sshTransport) Read(p []byte) (int, error) {
+	n, err := t.Conn.Read(p)
+	t.check(err)
+	return n, err
+}
+
+func (t *sshTransport) Write(p []byte) (int, error) {
+	n, err := t.Conn.Write(p)
+	t.check(err)
+	return n, err
+}
+
+func (t *sshTransport) check(err error) {
+	if err != nil && atomic.LoadInt32(&t.closed) == 0 {
+		atomic.StoreInt32(&t.failed, 1)
+	}
+}
+
+func (t *sshTransport) Close() error {
+	atomic.StoreInt32(&t.closed, 1)
+	return t.Conn.Close()
+}
+
+func (t *sshTransport) broken() bool {
+	return atomic.LoadInt32(&t.failed) == 1
+}
+
+func sshShell(channel *Channel) {
+	// the hub passes the proxy's status on to the tunnel side, a direct
+	// channel has no proxy and the tunnel side gets its own
+	ended := channel.proxy
+	if ended == nil {
+		ended = channel.tunnel
+	}
+	defer func(id uuid.UUID) {
+		// runHandler tears the channel down
+		ended.SetCloseStatus(closeSSHFailed, "ssh session failed")
+		if r := recover(); r != nil {
+			fmt.Printf("Exception handled in sshShell for channel %v: %v\n", id, r)
+		}
+	}(channel.id)
+
+	params := channel.tunnel.Params()
+	username := params.Get("username")
+	term := &pty{}
+	term.cols, _ = strconv.Atoi(params.Get("cols"))
+	term.rows, _ = strconv.Atoi(params.Get("rows"))
+	wsWrapper := newConn(channel.tunnel, term.resize)
+	defer wsWrapper.Close()
+	textFrames := params.Get("frames") == "text"
+	out := newTerminalWriter(wsWrapper, textFrames)
+
+	var password string
+	if channel.tunnel.params["password"] != nil {
+		password = channel.tunnel.params["password"][0]
+	}
+
+	// a failed handshake is an authentication failure if we got to send a
+	// password, and the connection to the server is still up
+	var attempted int32
+	authMethod := ssh.PasswordCallback(func() (string, error) {
+		atomic.StoreInt32(&attempted, 1)
+		if len(password) > 0 {
+			return password, nil
+		}
+		fmt.Fprintf(out, "%s password: ", username)
+
+		scanner := bufio.NewScanner(wsWrapper)
+		scanner.Scan()
+		pwd := strings.TrimSpace(scanner.Text())
+
+		out.Write([]byte("\r\n"))
+		return pwd, nil
+	})
+
+	config := &ssh.ClientConfig{
+		Config: ssh.Config{Ciphers: getSupportedCiphers()},
+		User:   username,
+		Auth: []ssh.AuthMethod{
+			authMethod,
+		},
+		// the proxy or the direct= of the channel picks the server, there's
+		// no known_hosts to check it against; once the key exchange is
+		// done, we're authenticating
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			sendStatus(channel.tunnel, "authenticating as "+username)
+			return nil
+		},
+	}
+
+	var serverConn net.Conn
+	addr := "localhost"
+	if len(channel.direct) > 0 {
+		sendStatus(channel.tunnel, "connecting to "+channel.direct)
+		conn, err := dialDirect(channel.hub, channel.direct)
+		if err != nil {
+			log.Printf("Couldn't connect to %s for channel %v: %v\n", channel.direct, channel.id, err)
+			ended.SetCloseStatus(closeSSHFailed, err.Error())
+			return
+		}
+		serverConn, addr = conn, channel.direct
+	} else {
+		if channel.tunnel.params["target"] != nil {
+			target := channel.tunnel.params["target"][0]
+			if err := sendControl(channel.proxy, controlMessage{Type: controlTarget, Target: target}); err != nil {
+				log.Println("Error requesting target:", err)
+				return
+			}
+		}
+
+		sendStatus(channel.tunnel, "connecting to the ssh server")
+		serverConn = NewConn(channel.proxy)
+	}
+	transport := &sshTransport{Conn: serverConn}
+	defer transport.Close()
+	c, chans, reqs, err := ssh.NewClientConn(transport, addr, config)
+	if err != nil {
+		log.Println("Error NewClientConn:", err)
+		if atomic.LoadInt32(&attempted) == 1 && !transport.broken() {
+			ended.SetCloseStatus(closeAuthFailed, "authentication failed")
+		} else {
+			ended.SetCloseStatus(closeSSHFailed, err.Error())
+		}
+		return
+	}
+
+	client := ssh.NewClient(c, chans, reqs)
+
+	session, err := client.NewSession()
+	if err != nil {
+		log.Println("Failed to create session: ", err)
+		return
+	}
+	defer session.Close()
+
+	// Set up terminal modes
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,     // disable echoing
+		ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
+		ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
+	}
+
+	log.Println("Requesting pseudo-terminal")
+	if err = term.request(session, modes); err != nil {
+		log.Println("request for pseudo terminal failed: ", err)
+		return
+	}
+
+	// the watchers get the output too, and co-drivers type along
+	input, inputWriter := io.Pipe()
+	shared := newShare(channel, inputWriter)
+	term.share(shared)
+	go func() {
+		_, err := io.Copy(inputWriter, wsWrapper)
+		inputWriter.CloseWithError(err)
+	}()
+
+	// each has its own cut characters, they're written concurrently
+	session.Stdout = io.MultiWriter(out, shared)
+	session.Stderr = io.MultiWriter(newTerminalWriter(wsWrapper, textFrames), shared)
+	session.Stdin = input
+
+	if err := session.Shell(); nil != err {
+		log.Println("Unable to execute command:", err)
+		return
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go shared.serve(term, done)
+
+	log.Println("Waiting")
+	err = session.Wait()
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		sendExit(channel.tunnel, exitErr.ExitStatus())
+		ended.SetCloseStatus(exitStatusClose(exitErr.ExitStatus()))
+	} else if err != nil {
+		log.Println("Unable to execute command:", err)
+	} else {
+		sendExit(channel.tunnel, 0)
+		ended.SetCloseStatus(exitStatusClose(0))
+	}
+}
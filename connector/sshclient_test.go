@@ -0,0 +1,138 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/wegel/wwscc/wwsclient"
+	"golang.org/x/crypto/ssh"
+)
+
+// testPolicy is a direct ssh policy of the given rules.
+func testPolicy(t testing.TB, rules ...string) *wwsclient.Policy {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy")
+	if err := ioutil.WriteFile(path, []byte(strings.Join(rules, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := wwsclient.LoadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
+
+// testSSHServer accepts connections whose password passes check, with the
+// raw connection to close from it. Their sessions run testShell.
+func testSSHServer(t testing.TB, check func(conn net.Conn, password string) bool) string {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			config := &ssh.ServerConfig{
+				PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+					if check(conn, string(password)) {
+						return nil, nil
+					}
+					return nil, errors.New("wrong password")
+				},
+			}
+			config.AddHostKey(signer)
+			go func() {
+				defer conn.Close()
+				sc, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				defer sc.Close()
+				go ssh.DiscardRequests(reqs)
+				for ch := range chans {
+					go testShell(ch)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// testShell echoes what it's sent, like a terminal would.
+func testShell(newChannel ssh.NewChannel) {
+	ch, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	go func() {
+		for req := range requests {
+			req.Reply(req.Type == "pty-req" || req.Type == "shell" || req.Type == "window-change", nil)
+		}
+	}()
+	io.Copy(ch, ch)
+}
+
+// testCloseCode reads from ws until it's closed, returning the close code.
+func testCloseCode(t testing.TB, ws *websocket.Conn) int {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			if ce, ok := err.(*websocket.CloseError); ok {
+				return ce.Code
+			}
+			t.Fatalf("not closed with a code: %v", err)
+		}
+	}
+}
+
+func TestSSHAuthFailed(t *testing.T) {
+	addr := testSSHServer(t, func(conn net.Conn, password string) bool {
+		return password == "right"
+	})
+	_, srv := testConnector(t, &Options{DirectSSH: testPolicy(t, addr)})
+	id := testCreate(t, srv, "type=ssh&direct="+addr)
+	ws := testDial(t, srv, "tunnel/"+id+"?username=u&password=wrong")
+	if code := testCloseCode(t, ws); code != closeAuthFailed {
+		t.Errorf("closed with %d, want %d", code, closeAuthFailed)
+	}
+}
+
+func TestSSHLostWhileAuthenticating(t *testing.T) {
+	addr := testSSHServer(t, func(conn net.Conn, password string) bool {
+		conn.Close()
+		return false
+	})
+	_, srv := testConnector(t, &Options{DirectSSH: testPolicy(t, addr)})
+	id := testCreate(t, srv, "type=ssh&direct="+addr)
+	ws := testDial(t, srv, "tunnel/"+id+"?username=u&password=any")
+	if code := testCloseCode(t, ws); code != closeSSHFailed {
+		t.Errorf("closed with %d, want %d", code, closeSSHFailed)
+	}
+}
@@ -0,0 +1,50 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/wegel/wwscc/wwswebterminal"
+)
+
+// terminalHandler serves the built-in web terminal under /terminal/. The
+// page finds the websockets relative to its own URL, so it keeps working
+// when the handler is mounted under a prefix.
+func terminalHandler() http.Handler {
+	files := http.FileServer(http.FS(wwswebterminal.Files))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/terminal")
+		if path == "/" {
+			path = "/terminal.html"
+		}
+		r = r.Clone(r.Context())
+		r.URL.Path = path
+		files.ServeHTTP(w, r)
+	})
+}
+
+// sshLink sends the browser to the terminal, which creates an ssh channel
+// handed to agent, or direct to an ssh server. It doesn't create it itself:
+// a link anyone can put on their site would open channels with the user's
+// cookies and network access. The page's POST to /create carries the CSRF
+// token, which other sites can't get.
+func sshLink(w http.ResponseWriter, r *http.Request, agent, direct string) {
+	query := url.Values{}
+	if len(direct) > 0 {
+		query.Set("direct", direct)
+	} else {
+		query.Set("agent", agent)
+	}
+	for _, name := range []string{"username", "target"} {
+		if value := r.URL.Query().Get(name); len(value) > 0 {
+			query.Set(name, value)
+		}
+	}
+	// relative, for when the connector is mounted under a prefix
+	w.Header().Set("Location", "../terminal/?"+query.Encode())
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusSeeOther)
+}
@@ -0,0 +1,175 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTerminalHandler(t *testing.T) {
+	_, srv := testConnector(t, &Options{Terminal: true})
+	for path, want := range map[string]string{
+		"/terminal/":               "<title>SSH Terminal</title>",
+		"/terminal/terminal.html":  "<title>SSH Terminal</title>",
+		"/terminal/xterm/xterm.js": "Terminal",
+	} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(buf), want) {
+			t.Errorf("%s: %s, want a page with %q", path, resp.Status, want)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/terminal/nope.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing file: %s", resp.Status)
+	}
+
+	// not served unless enabled
+	_, srv = testConnector(t, &Options{})
+	if resp, err = http.Get(srv.URL + "/terminal/"); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("terminal disabled: %s", resp.Status)
+	}
+}
+
+func TestParseControl(t *testing.T) {
+	for data, want := range map[string]string{
+		`{"type":"resize","cols":80,"rows":24}`: controlResize,
+		`{"type":"eof"}`:                        controlEOF,
+		// keystrokes sent as text by older pages
+		`ls -l`:         "",
+		`{`:             "",
+		`{"cols":80}`:   "",
+		` {"type":"x"}`: "",
+	} {
+		got := ""
+		if msg, ok := parseControl([]byte(data)); ok {
+			got = msg.Type
+		}
+		if got != want {
+			t.Errorf("%s: got %q, want %q", data, got, want)
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	h, srv := testConnector(t, &Options{})
+	sizes := make(chan [2]int, 4)
+	h.RegisterType("sized", func(channel *Channel) {
+		conn := newConn(channel.Tunnel(), func(cols, rows int) {
+			sizes <- [2]int{cols, rows}
+		})
+		defer conn.Close()
+		// resizes are handled while reading the data
+		buf := make([]byte, 4)
+		conn.Read(buf)
+		conn.Write(buf)
+	})
+
+	id := testCreate(t, srv, "type=sized")
+	tunnel := testDial(t, srv, "tunnel/"+id)
+	testDial(t, srv, "proxy/"+id)
+	tunnel.WriteMessage(websocket.TextMessage, []byte(`{"type":"resize","cols":120,"rows":40}`))
+	tunnel.WriteMessage(websocket.BinaryMessage, []byte("done"))
+	if _, buf := testRead(t, tunnel); string(buf) != "done" {
+		t.Fatalf("got %q", buf)
+	}
+	select {
+	case size := <-sizes:
+		if size != [2]int{120, 40} {
+			t.Errorf("resized to %v", size)
+		}
+	default:
+		t.Error("not resized")
+	}
+}
+
+func TestPtyResize(t *testing.T) {
+	term := &pty{cols: 80, rows: 24}
+	term.resize(0, 50)
+	term.resize(100, -1)
+	if cols, rows := term.size(); cols != 80 || rows != 24 {
+		t.Errorf("resized to %dx%d by a bogus size", cols, rows)
+	}
+	term.resize(100, 50)
+	if cols, rows := term.size(); cols != 100 || rows != 50 {
+		t.Errorf("size %dx%d, want 100x50", cols, rows)
+	}
+}
+
+func TestSSHLink(t *testing.T) {
+	h, srv := testConnector(t, &Options{Terminal: true, Authorize: testAgents})
+	agent, _, err := dialAgent(t, srv.URL, "db", "db-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitAgent(t, h, "db")
+
+	// links only redirect, even from another site with the user's cookies
+	token, cookie := testCSRF(t, srv)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	for path, want := range map[string]string{
+		"/ssh/db?username=ubuntu&target=host:22": "../terminal/?agent=db&target=host%3A22&username=ubuntu",
+		"/ssh-direct/bastion:22":                 "../terminal/?direct=bastion%3A22",
+	} {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		req.Header.Set("Sec-Fetch-Site", "cross-site")
+		req.AddCookie(cookie)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != want {
+			t.Errorf("%s: %s to %q, want %q", path, resp.Status, resp.Header.Get("Location"), want)
+		}
+	}
+
+	// the page creates the channel, with the CSRF token
+	create := func(token string) *http.Response {
+		req, _ := http.NewRequest("POST", srv.URL+"/create?type=ssh&agent=db", nil)
+		req.Header.Set("Origin", srv.URL)
+		req.Header.Set(csrfHeader, token)
+		req.AddCookie(cookie)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	resp := create("")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("create without the token: %s", resp.Status)
+	}
+	resp = create(token)
+	id, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("create: %s: %s", resp.Status, id)
+	}
+	// the first channel the agent hears of, the links created none
+	if attach := readAttach(t, agent); attach != string(bytes.TrimSpace(id)) {
+		t.Errorf("agent asked to attach to %s, want %s", attach, id)
+	}
+}
@@ -0,0 +1,287 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// Watchers join a running ssh session on /ws/watch/<id>, to see the same
+// output as its tunnel side. The tunnel side shares its session with
+// share=view in its URL, or share=drive to also let the watchers asking for
+// it with mode=drive type along. It's told when someone joins or leaves.
+//
+// The hub keeps track of the watchers of each channel and closes them with
+// it. The session hands them its output through a queue each, so that a
+// slow watcher is dropped rather than slowing the session down.
+
+const (
+	maxWatchers = 16
+	// Writes waiting to be sent to a watcher before it's dropped.
+	watcherQueue = 256
+	// Time a dropped watcher gets to take its close frame: its connection is
+	// backed up, it may never.
+	dropWait = time.Second
+)
+
+type watcher struct {
+	client  *Client
+	drives  bool
+	out     *terminalWriter
+	writes  chan func() error // closed once the watcher is removed
+	dropped bool              // being closed for not keeping up
+}
+
+// share is the watchers side of an ssh session.
+type share struct {
+	channel *Channel
+	allowed string    // share= of the tunnel side
+	input   io.Writer // the session's input, for co-drivers
+
+	mu       sync.Mutex
+	watchers map[*Client]*watcher
+	closed   bool
+}
+
+func newShare(channel *Channel, input io.Writer) *share {
+	return &share{
+		channel:  channel,
+		allowed:  channel.tunnel.Params().Get("share"),
+		input:    input,
+		watchers: make(map[*Client]*watcher),
+	}
+}
+
+// serve takes in the watchers the hub hands over, until done is closed.
+func (s *share) serve(term *pty, done <-chan struct{}) {
+	for {
+		select {
+		case c := <-s.channel.join:
+			s.add(c, term)
+		case <-done:
+			s.close()
+			return
+		}
+	}
+}
+
+func (s *share) add(c *Client, term *pty) {
+	conn := newConn(c, nil)
+	w := &watcher{
+		client: c,
+		drives: s.allowed == "drive" && c.Params().Get("mode") == "drive",
+		out:    newTerminalWriter(conn, c.Params().Get("frames") == "text"),
+		writes: make(chan func() error, watcherQueue),
+	}
+	go func() {
+		for write := range w.writes {
+			if err := write(); err != nil {
+				// the reader below cleans up
+				c.ws.Close()
+				return
+			}
+		}
+	}()
+
+	role := "an observer"
+	if w.drives {
+		role = "a co-driver"
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		close(w.writes)
+		return
+	}
+	s.watchers[c] = w
+	cols, rows := term.size()
+	s.queue(w, func() error {
+		return sendControl(c, controlMessage{Type: controlResize, Cols: cols, Rows: rows})
+	})
+	s.mu.Unlock()
+
+	if w.drives {
+		sendNotice(c, "you joined the session and can type")
+	} else {
+		sendNotice(c, "you joined the session, read-only")
+	}
+	log.Printf("Watcher %s joined channel ID %v as %s", watcherName(c), c.channelID, role)
+	sendNotice(s.channel.tunnel, fmt.Sprintf("%s joined: %s", role, watcherName(c)))
+
+	go func() {
+		var err error
+		if w.drives {
+			_, err = io.Copy(s.input, conn)
+		} else {
+			_, err = io.Copy(ioutil.Discard, conn)
+		}
+		// done writing, but still watching
+		for err == nil {
+			_, _, err = c.ReadMessage()
+		}
+		if s.remove(c) {
+			log.Printf("Watcher %s left channel ID %v: %v", watcherName(c), c.channelID, err)
+			sendNotice(s.channel.tunnel, fmt.Sprintf("%s left: %s", role, watcherName(c)))
+		}
+		c.hub.disconnected <- c
+	}()
+}
+
+// queue must be called with mu held. Closing the watcher ends its reader,
+// which removes it.
+func (s *share) queue(w *watcher, write func() error) {
+	if w.dropped {
+		return
+	}
+	select {
+	case w.writes <- write:
+	default:
+		log.Printf("Watcher %s can't keep up on channel ID %v, dropping it", watcherName(w.client), w.client.channelID)
+		w.dropped = true
+		c := w.client
+		go func() {
+			c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closePeerLost, "can't keep up with the session"), time.Now().Add(dropWait))
+			c.ws.Close()
+		}()
+	}
+}
+
+// Write copies the session's output to the watchers.
+func (s *share) Write(b []byte) (int, error) {
+	buf := append([]byte(nil), b...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, w := range s.watchers {
+		out := w.out
+		s.queue(w, func() error {
+			_, err := out.Write(buf)
+			return err
+		})
+	}
+	return len(b), nil
+}
+
+// resized tells the watchers the session's new size, for them to match it.
+func (s *share) resized(cols, rows int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, w := range s.watchers {
+		c := w.client
+		s.queue(w, func() error {
+			return sendControl(c, controlMessage{Type: controlResize, Cols: cols, Rows: rows})
+		})
+	}
+}
+
+// remove reports whether the watcher was still there.
+func (s *share) remove(c *Client) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w, ok := s.watchers[c]
+	if ok {
+		delete(s.watchers, c)
+		close(w.writes)
+	}
+	return ok
+}
+
+// close stops the writers once the session is over; the hub closes the
+// watchers with the channel.
+func (s *share) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for c, w := range s.watchers {
+		delete(s.watchers, c)
+		close(w.writes)
+	}
+}
+
+func watcherName(c *Client) string {
+	if name := c.Params().Get("name"); len(name) > 0 {
+		return fmt.Sprintf("%s (%s)", name, c.addr)
+	}
+	return c.addr
+}
+
+func sendNotice(c *Client, message string) {
+	if err := sendControl(c, controlMessage{Type: controlNotice, Message: message}); err != nil {
+		log.Printf("Couldn't send notice to %s on %v: %v\n", c.remoteType, c.channelID, err)
+	}
+}
+
+func serveWatcher(hub *Hub, w http.ResponseWriter, r *http.Request, channelID uuid.UUID) {
+	ws, err := hub.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Print("upgrade:", err)
+		return
+	}
+	defer ws.Close()
+
+	client := &Client{hub: hub, ws: ws, addr: remoteIP(r), channelID: channelID, params: r.URL.Query(), remoteType: "watcher"}
+	hub.watch <- client
+	keepalive(client)
+}
+
+// The watcher side of the hub loop.
+
+func (h *Hub) addWatcher(c *Client) {
+	channel, ok := h.channels[c.channelID]
+	if !ok {
+		log.Printf("Watcher from %s failed for channel ID %v, channel ID unknown\n", c.addr, c.channelID.String())
+		h.guard.unknownChannel(c.addr)
+		h.guard.tarTrap(c)
+		return
+	}
+
+	refuse := ""
+	switch {
+	case channel.kind != "ssh" || !channel.started():
+		refuse = "no ssh session running"
+	case channel.next != nil:
+		refuse = "the session runs on another connector"
+	case len(channel.tunnel.Params().Get("share")) == 0:
+		refuse = "session not shared"
+	case len(channel.watchers) >= maxWatchers:
+		refuse = "too many watchers"
+	default:
+		// the session may not be taking them in yet
+		select {
+		case channel.join <- c:
+		default:
+			refuse = "too many watchers"
+		}
+	}
+	if len(refuse) > 0 {
+		log.Printf("Refusing watcher from %s for channel ID %v: %s\n", c.addr, c.channelID.String(), refuse)
+		go c.CloseWith(closeNotShared, refuse)
+		return
+	}
+
+	channel.watchers[c] = true
+	h.notify(attachedEvent(channel, c))
+}
+
+func (h *Hub) removeWatcher(c *Client) {
+	c.ws.Close()
+	if channel, ok := h.channels[c.channelID]; ok {
+		delete(channel.watchers, c)
+	}
+}
+
+// closeWatchers must only be called from the hub loop.
+func (h *Hub) closeWatchers(channel *Channel, code int, reason string) {
+	for c := range channel.watchers {
+		go c.CloseWith(code, reason)
+		delete(channel.watchers, c)
+	}
+}
@@ -0,0 +1,124 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testSession starts a direct ssh session shared with share=, echoing what
+// the tunnel side types.
+func testSession(t *testing.T, share string) (srv *httptest.Server, id string, tunnel *websocket.Conn) {
+	t.Helper()
+	addr := testSSHServer(t, func(net.Conn, string) bool { return true })
+	_, srv = testConnector(t, &Options{DirectSSH: testPolicy(t, addr)})
+	id = testCreate(t, srv, "type=ssh&direct="+addr)
+	tunnel = testDial(t, srv, "tunnel/"+id+"?username=u&password=p&share="+share)
+	tunnel.WriteMessage(websocket.BinaryMessage, []byte("ready"))
+	waitData(t, tunnel, "ready")
+	return
+}
+
+// waitData reads the data sent to ws until it has want, returning it all.
+func waitData(t *testing.T, ws *websocket.Conn, want string) string {
+	t.Helper()
+	var got []byte
+	for !bytes.Contains(got, []byte(want)) {
+		messageType, buf := testRead(t, ws)
+		if messageType == websocket.BinaryMessage {
+			got = append(got, buf...)
+		}
+	}
+	return string(got)
+}
+
+// waitNotice reads what's sent to ws until a notice with want.
+func waitNotice(t *testing.T, ws *websocket.Conn, want string) {
+	t.Helper()
+	for {
+		messageType, buf := testRead(t, ws)
+		var msg controlMessage
+		if messageType == websocket.TextMessage && json.Unmarshal(buf, &msg) == nil &&
+			msg.Type == controlNotice && strings.Contains(msg.Message, want) {
+			return
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	srv, id, tunnel := testSession(t, "drive")
+
+	viewer := testDial(t, srv, "watch/"+id+"?name=bob")
+	waitNotice(t, tunnel, "an observer joined: bob")
+	waitNotice(t, viewer, "read-only")
+	driver := testDial(t, srv, "watch/"+id+"?name=carol&mode=drive")
+	waitNotice(t, tunnel, "a co-driver joined: carol")
+	waitNotice(t, driver, "can type")
+
+	// the watchers see the session's output
+	tunnel.WriteMessage(websocket.BinaryMessage, []byte("hi"))
+	waitData(t, viewer, "hi")
+	waitData(t, driver, "hi")
+
+	// only co-drivers type along
+	viewer.WriteMessage(websocket.BinaryMessage, []byte("xx"))
+	driver.WriteMessage(websocket.BinaryMessage, []byte("yo"))
+	if got := waitData(t, tunnel, "yo"); strings.Contains(got, "xx") {
+		t.Errorf("an observer typed: %q", got)
+	}
+	waitData(t, viewer, "yo")
+
+	viewer.Close()
+	waitNotice(t, tunnel, "an observer left: bob")
+}
+
+func TestWatchRefused(t *testing.T) {
+	srv, id, _ := testSession(t, "")
+	watcher := testDial(t, srv, "watch/"+id)
+	if code := testCloseCode(t, watcher); code != closeNotShared {
+		t.Errorf("unshared session: closed with %d, want %d", code, closeNotShared)
+	}
+
+	// not an ssh session
+	id = testCreate(t, srv, "")
+	testDial(t, srv, "tunnel/"+id+"?share=view")
+	testDial(t, srv, "proxy/"+id)
+	watcher = testDial(t, srv, "watch/"+id)
+	if code := testCloseCode(t, watcher); code != closeNotShared {
+		t.Errorf("tunnel channel: closed with %d, want %d", code, closeNotShared)
+	}
+}
+
+func TestWatchSlow(t *testing.T) {
+	srv, id, tunnel := testSession(t, "view")
+	// never reads
+	testDial(t, srv, "watch/"+id+"?name=slow")
+	waitNotice(t, tunnel, "an observer joined: slow")
+
+	// output until it can't keep up, the session goes on
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		chunk := bytes.Repeat([]byte("x"), 16<<10)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if tunnel.WriteMessage(websocket.BinaryMessage, chunk) != nil {
+				return
+			}
+		}
+	}()
+	tunnel.SetReadDeadline(time.Now().Add(30 * time.Second))
+	waitNotice(t, tunnel, "an observer left: slow")
+}
@@ -0,0 +1,204 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Channel lifecycle events are handed to the OnEvent hook, and POSTed as JSON
+// to every webhook URL. Each URL has its own queue and goroutine, so a
+// receiver that is down only delays its own events. Failed deliveries are
+// retried with exponential backoff; when a queue is full, new events for that
+// URL are dropped rather than holding up the hub.
+//
+// With a WebhookSecret, the body is signed with HMAC-SHA256 and the hex
+// digest sent in the X-WWS-Signature header as "sha256=<digest>".
+
+const (
+	EventCreated   = "channel.created"
+	EventAttached  = "channel.attached"
+	EventStarted   = "channel.started"
+	EventDestroyed = "channel.destroyed"
+)
+
+type Event struct {
+	ID      string      `json:"id"` // the same across retries
+	Event   string      `json:"event"`
+	Time    time.Time   `json:"time"`
+	Channel string      `json:"channel"`
+	Type    string      `json:"type"`
+	Side    string      `json:"side,omitempty"`   // attached: the side, destroyed: the side that ended it
+	Remote  string      `json:"remote,omitempty"` // IP of the side, or of the creator
+	Code    int         `json:"code,omitempty"`
+	Reason  string      `json:"reason,omitempty"`
+	Bytes   *EventBytes `json:"bytes,omitempty"`
+}
+
+// Bytes relayed from each side, over the channel's life.
+type EventBytes struct {
+	FromProxy  uint64 `json:"from_proxy"`
+	FromTunnel uint64 `json:"from_tunnel"`
+}
+
+type notifier struct {
+	targets []*webhookTarget
+	secret  []byte
+	client  *http.Client
+	retries int
+	backoff time.Duration // before the first retry, doubled for each one after
+	pending int64         // events queued or being delivered, atomic
+}
+
+type webhookTarget struct {
+	url   string
+	queue chan Event
+}
+
+// Longest wait between two retries.
+const maxWebhookBackoff = time.Minute
+
+func newNotifier(urls []string, secret []byte, queueLen, retries int) *notifier {
+	n := &notifier{
+		secret:  secret,
+		client:  &http.Client{Timeout: writeWait},
+		retries: retries,
+		backoff: time.Second,
+	}
+	for _, url := range urls {
+		target := &webhookTarget{url: url, queue: make(chan Event, queueLen)}
+		n.targets = append(n.targets, target)
+		go n.deliver(target)
+	}
+	return n
+}
+
+// notify hands event to the OnEvent hook, and queues it for the webhooks.
+// Must only be called from the hub loop.
+func (h *Hub) notify(event Event) {
+	event.ID = uuid.New().String()
+	event.Time = time.Now().UTC()
+	if onEvent := h.options().OnEvent; onEvent != nil {
+		onEvent(event)
+	}
+	h.webhooks.notify(event)
+}
+
+// notify queues event for every URL, without blocking. A nil notifier
+// (no webhooks) does nothing.
+func (n *notifier) notify(event Event) {
+	if n == nil {
+		return
+	}
+	for _, target := range n.targets {
+		atomic.AddInt64(&n.pending, 1)
+		select {
+		case target.queue <- event:
+		default:
+			atomic.AddInt64(&n.pending, -1)
+			log.Printf("Webhook queue for %s full, dropping %s event for channel ID: %v\n", target.url, event.Event, event.Channel)
+		}
+	}
+}
+
+func (n *notifier) deliver(target *webhookTarget) {
+	for event := range target.queue {
+		body, err := json.Marshal(event)
+		if err == nil {
+			err = n.post(target.url, body)
+			for try, wait := 0, n.backoff; err != nil && try < n.retries; try++ {
+				time.Sleep(wait)
+				if wait *= 2; wait > maxWebhookBackoff {
+					wait = maxWebhookBackoff
+				}
+				err = n.post(target.url, body)
+			}
+		}
+		if err != nil {
+			log.Printf("Giving up on %s event for channel ID %v to %s: %v\n", event.Event, event.Channel, target.url, err)
+		}
+		atomic.AddInt64(&n.pending, -1)
+	}
+}
+
+func (n *notifier) post(url string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(n.secret) > 0 {
+		mac := hmac.New(sha256.New, n.secret)
+		mac.Write(body)
+		req.Header.Set("X-WWS-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver replied %s", resp.Status)
+	}
+	return nil
+}
+
+// flush waits up to timeout for the queued events to be delivered (or given
+// up on), so that shutting down doesn't lose the last ones.
+func (n *notifier) flush(timeout time.Duration) {
+	if n == nil {
+		return
+	}
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&n.pending) > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if left := atomic.LoadInt64(&n.pending); left > 0 {
+		log.Printf("Exiting with %d webhook deliveries left\n", left)
+	}
+}
+
+// The events, built from the hub loop.
+
+func channelEvent(event string, channel *Channel) Event {
+	return Event{Event: event, Channel: channel.id.String(), Type: channel.kind}
+}
+
+func createdEvent(channel *Channel) Event {
+	e := channelEvent(EventCreated, channel)
+	e.Remote = channel.creator
+	return e
+}
+
+func attachedEvent(channel *Channel, client *Client) Event {
+	e := channelEvent(EventAttached, channel)
+	e.Side, e.Remote = client.remoteType, client.addr
+	return e
+}
+
+// destroyedEvent records why the channel ended: the side that ended it (if
+// any), and the close code and reason passed on to the others.
+func destroyedEvent(channel *Channel, side string, code int, reason string) Event {
+	e := channelEvent(EventDestroyed, channel)
+	e.Side, e.Code, e.Reason = side, code, reason
+	e.Bytes = &EventBytes{
+		FromProxy:  atomic.LoadUint64(&channel.fromProxy.total),
+		FromTunnel: atomic.LoadUint64(&channel.fromTunnel.total),
+	}
+	return e
+}
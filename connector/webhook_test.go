@@ -0,0 +1,145 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package connector
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// receiver records the deliveries, failing the first fail of them.
+type receiver struct {
+	mu     sync.Mutex
+	fail   int
+	bodies [][]byte
+	sigs   []string
+	times  []time.Time
+}
+
+func (rcv *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	rcv.bodies = append(rcv.bodies, body)
+	rcv.sigs = append(rcv.sigs, r.Header.Get("X-WWS-Signature"))
+	rcv.times = append(rcv.times, time.Now())
+	if len(rcv.bodies) <= rcv.fail {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}
+}
+
+func (rcv *receiver) deliveries() int {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return len(rcv.bodies)
+}
+
+// testNotifier delivers to url with a short backoff.
+func testNotifier(url string, secret []byte, queueLen, retries int) *notifier {
+	n := &notifier{secret: secret, client: &http.Client{Timeout: writeWait}, retries: retries, backoff: 20 * time.Millisecond}
+	target := &webhookTarget{url: url, queue: make(chan Event, queueLen)}
+	n.targets = append(n.targets, target)
+	go n.deliver(target)
+	return n
+}
+
+func waitDelivered(t *testing.T, n *notifier) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&n.pending) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("events still pending")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	rcv := &receiver{}
+	srv := httptest.NewServer(rcv)
+	defer srv.Close()
+
+	secret := []byte("s3cret")
+	n := testNotifier(srv.URL, secret, 10, 0)
+	n.notify(Event{ID: "1", Event: EventCreated, Channel: "abc"})
+	waitDelivered(t, n)
+
+	if rcv.deliveries() != 1 {
+		t.Fatalf("%d deliveries, want 1", rcv.deliveries())
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(rcv.bodies[0])
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); rcv.sigs[0] != want {
+		t.Errorf("signature %q, want %q", rcv.sigs[0], want)
+	}
+	var event Event
+	if err := json.Unmarshal(rcv.bodies[0], &event); err != nil || event.Channel != "abc" {
+		t.Errorf("got %s: %v", rcv.bodies[0], err)
+	}
+
+	// no secret, no signature
+	n = testNotifier(srv.URL, nil, 10, 0)
+	n.notify(Event{ID: "2", Event: EventCreated})
+	waitDelivered(t, n)
+	if rcv.sigs[1] != "" {
+		t.Errorf("signed without a secret: %q", rcv.sigs[1])
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	rcv := &receiver{fail: 2}
+	srv := httptest.NewServer(rcv)
+	defer srv.Close()
+
+	n := testNotifier(srv.URL, nil, 10, 5)
+	n.notify(Event{ID: "1", Event: EventCreated})
+	waitDelivered(t, n)
+
+	if rcv.deliveries() != 3 {
+		t.Fatalf("%d deliveries, want 3", rcv.deliveries())
+	}
+	for i := 1; i < 3; i++ {
+		if string(rcv.bodies[i]) != string(rcv.bodies[0]) {
+			t.Error("a retry changed the event")
+		}
+	}
+	// the wait doubles
+	if first, second := rcv.times[1].Sub(rcv.times[0]), rcv.times[2].Sub(rcv.times[1]); first < n.backoff || second < 2*n.backoff {
+		t.Errorf("retried after %v then %v, backoff %v", first, second, n.backoff)
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	rcv := &receiver{fail: 100}
+	srv := httptest.NewServer(rcv)
+	defer srv.Close()
+
+	n := testNotifier(srv.URL, nil, 10, 2)
+	n.notify(Event{ID: "1", Event: EventCreated})
+	waitDelivered(t, n)
+	if rcv.deliveries() != 3 {
+		t.Errorf("%d deliveries, want the first and 2 retries", rcv.deliveries())
+	}
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	// nothing delivers, the queue fills up
+	n := &notifier{}
+	target := &webhookTarget{url: "http://127.0.0.1:0", queue: make(chan Event, 2)}
+	n.targets = append(n.targets, target)
+	for i := 0; i < 5; i++ {
+		n.notify(Event{Event: EventCreated})
+	}
+	if len(target.queue) != 2 || atomic.LoadInt64(&n.pending) != 2 {
+		t.Errorf("%d queued, %d pending, want 2", len(target.queue), n.pending)
+	}
+}
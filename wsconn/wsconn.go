@@ -0,0 +1,266 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+// Package wsconn turns a websocket into a net.Conn carrying a byte stream,
+// one message per Write. It's shared by wwsconnector (the ssh channels) and
+// wwscat.
+//
+// Read, Write and Close may be called concurrently, and deadlines behave
+// like a net.Conn's: a Read that timed out can be retried once the deadline
+// is pushed back, without losing data.
+package wsconn
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Socket is what we need from a websocket: *websocket.Conn has it all, or a
+// wrapper adding encryption, compression or locking.
+type Socket interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetWriteDeadline(t time.Time) error
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+var (
+	ErrClosed      = errors.New("wsconn: use of closed connection")
+	ErrWriteClosed = errors.New("wsconn: write after CloseWrite")
+)
+
+// Returned once a deadline passed.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "wsconn: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Time allowed to send the close frame.
+const closeWait = time.Second
+
+// eofMessage is the text message CloseWrite sends, the "eof" control message
+// of the channels.
+var eofMessage = []byte(`{"type":"eof"}`)
+
+type Conn struct {
+	// Called with the text messages read, which are data if it's nil. Set
+	// it before the first Read. An error is returned by that Read, the next
+	// one goes on reading.
+	OnText func(data []byte) error
+	// Called with the number of bytes each Read returns.
+	OnRead func(n int)
+
+	ws Socket
+
+	rmu      sync.Mutex // Read
+	pending  []byte     // rest of the message being read
+	readErr  error
+	pumping  sync.Once
+	messages chan message
+	rdl      deadline
+
+	wmu         sync.Mutex // writes
+	wdl         deadline
+	writeClosed bool
+
+	closing sync.Once
+	done    chan struct{} // closed by Close
+}
+
+type message struct {
+	messageType int
+	data        []byte
+	err         error
+}
+
+func New(ws Socket) *Conn {
+	return &Conn{
+		ws:       ws,
+		messages: make(chan message),
+		rdl:      makeDeadline(),
+		wdl:      makeDeadline(),
+		done:     make(chan struct{}),
+	}
+}
+
+// Read reads data from the binary messages (and text ones, without OnText).
+// It returns io.EOF once the other side called CloseWrite or closed
+// normally, and the *websocket.CloseError for any other close.
+func (c *Conn) Read(b []byte) (n int, err error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for len(c.pending) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if len(b) == 0 {
+			return 0, nil
+		}
+
+		c.pumping.Do(func() { go c.pump() })
+		select {
+		case m := <-c.messages:
+			switch {
+			case m.err != nil:
+				c.readErr = m.err
+				if ce, ok := m.err.(*websocket.CloseError); ok && ce.Code == websocket.CloseNormalClosure {
+					c.readErr = io.EOF
+				}
+			case m.messageType == websocket.TextMessage && c.OnText == nil && bytes.Equal(m.data, eofMessage):
+				c.readErr = io.EOF
+			case m.messageType == websocket.TextMessage && c.OnText != nil:
+				if err := c.OnText(m.data); err != nil {
+					return 0, err
+				}
+			default:
+				c.pending = m.data
+			}
+		case <-c.rdl.wait():
+			return 0, timeoutError{}
+		case <-c.done:
+			return 0, ErrClosed
+		}
+	}
+
+	n = copy(b, c.pending)
+	c.pending = c.pending[n:]
+	if c.OnRead != nil {
+		c.OnRead(n)
+	}
+	return n, nil
+}
+
+// pump reads messages for Read, one at a time so that a slow reader pushes
+// back on the other side.
+func (c *Conn) pump() {
+	for {
+		messageType, data, err := c.ws.ReadMessage()
+		select {
+		case c.messages <- message{messageType, data, err}:
+		case <-c.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ReadMessage reads the next message, for protocols carrying several streams
+// on one websocket. Don't mix it with Read.
+func (c *Conn) ReadMessage() (messageType int, data []byte, err error) {
+	return c.ws.ReadMessage()
+}
+
+// Write sends b to the other side, in one binary message.
+func (c *Conn) Write(b []byte) (n int, err error) {
+	if err = c.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// WriteMessage may be called concurrently with the other methods. Once
+// CloseWrite was called, it only sends text (control) messages.
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	select {
+	case <-c.done:
+		return ErrClosed
+	case <-c.wdl.wait():
+		return timeoutError{}
+	default:
+	}
+	if c.writeClosed && messageType != websocket.TextMessage {
+		return ErrWriteClosed
+	}
+
+	if err := c.ws.SetWriteDeadline(c.wdl.time()); err != nil {
+		return err
+	}
+	err := c.ws.WriteMessage(messageType, data)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return timeoutError{}
+	}
+	return err
+}
+
+// CloseWrite tells the other side we're done writing, like shutting down the
+// write side of a TCP connection: it reads io.EOF after what we wrote
+// before, and may go on writing to us. It sends the eof control message, not
+// a close frame, which gorilla answers with its own, closing both ways.
+func (c *Conn) CloseWrite() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.writeClosed {
+		return nil
+	}
+	c.writeClosed = true
+	if err := c.ws.SetWriteDeadline(c.wdl.time()); err != nil {
+		return err
+	}
+	return c.ws.WriteMessage(websocket.TextMessage, eofMessage)
+}
+
+// Close sends a normal close frame and closes the websocket. Blocked Reads
+// and Writes return.
+func (c *Conn) Close() error {
+	return c.CloseWith(websocket.CloseNormalClosure, "")
+}
+
+// CloseWith is Close with another close code and reason.
+func (c *Conn) CloseWith(code int, reason string) error {
+	err := ErrClosed
+	c.closing.Do(func() {
+		close(c.done)
+		// not under wmu: a blocked write would hold us, and WriteControl
+		// may be called concurrently with writes
+		c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(closeWait))
+		err = c.ws.Close()
+	})
+	return err
+}
+
+// Done is closed once the Conn is closed.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.rdl.set(t)
+	c.wdl.set(t)
+	return nil
+}
+
+// SetReadDeadline also applies to a Read already waiting.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.rdl.set(t)
+	return nil
+}
+
+// SetWriteDeadline applies to the Writes that didn't start yet: a Write
+// that times out while sending leaves the websocket unusable.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.wdl.set(t)
+	return nil
+}
@@ -0,0 +1,202 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package wsconn
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// pair connects two Conns through a real websocket.
+func pair(t *testing.T) (client, server *Conn) {
+	t.Helper()
+	accepted := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		accepted <- ws
+	}))
+	t.Cleanup(srv.Close)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server = New(ws), New(<-accepted)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return
+}
+
+func readString(t *testing.T, c *Conn, size int) string {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, size)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestPartialReads(t *testing.T) {
+	client, server := pair(t)
+	server.Write([]byte("hello"))
+	server.Write([]byte("world"))
+
+	// a Read doesn't go past the message, the next one gets the rest
+	for _, want := range []string{"hel", "lo", "wor", "ld"} {
+		if got := readString(t, client, 3); got != want {
+			t.Fatalf("read %q, want %q", got, want)
+		}
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	client, server := pair(t)
+
+	client.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err := client.Read(make([]byte, 8))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("read: %v, want a timeout", err)
+	}
+
+	// retried with the deadline pushed back, nothing is lost
+	server.Write([]byte("later"))
+	if got := readString(t, client, 8); got != "later" {
+		t.Fatalf("read %q", got)
+	}
+}
+
+func TestWriteDeadline(t *testing.T) {
+	client, _ := pair(t)
+	client.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := client.Write([]byte("x")); err == nil {
+		t.Fatal("wrote past the deadline")
+	}
+	client.SetWriteDeadline(time.Time{})
+	if _, err := client.Write([]byte("x")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	client, server := pair(t)
+	server.Write([]byte("sent before"))
+
+	client.Write([]byte("data"))
+	if err := client.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("more")); err != ErrWriteClosed {
+		t.Fatalf("write after CloseWrite: %v", err)
+	}
+
+	// the other side reads what was written, then io.EOF
+	if got := readString(t, server, 8); got != "data" {
+		t.Fatalf("read %q", got)
+	}
+	if _, err := server.Read(make([]byte, 8)); err != io.EOF {
+		t.Fatalf("read: %v, want io.EOF", err)
+	}
+
+	// and we still read what it sends
+	if got := readString(t, client, 16); got != "sent before" {
+		t.Fatalf("read %q", got)
+	}
+	if _, err := server.Write([]byte("sent after")); err != nil {
+		t.Fatalf("write after the other side's CloseWrite: %v", err)
+	}
+	if got := readString(t, client, 16); got != "sent after" {
+		t.Fatalf("read %q", got)
+	}
+}
+
+func TestCloseWith(t *testing.T) {
+	client, server := pair(t)
+	if err := client.CloseWith(4005, "replaced"); err != nil {
+		t.Fatal(err)
+	}
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := server.Read(make([]byte, 8))
+	if ce, ok := err.(*websocket.CloseError); !ok || ce.Code != 4005 || ce.Text != "replaced" {
+		t.Fatalf("read: %v, want close 4005", err)
+	}
+
+	if _, err := client.Read(make([]byte, 8)); err != ErrClosed {
+		t.Fatalf("read after close: %v", err)
+	}
+	if _, err := client.Write([]byte("x")); err != ErrClosed {
+		t.Fatalf("write after close: %v", err)
+	}
+	select {
+	case <-client.Done():
+	default:
+		t.Fatal("Done not closed")
+	}
+}
+
+func TestCloseUnblocksRead(t *testing.T) {
+	client, _ := pair(t)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := client.Read(make([]byte, 8))
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	client.Close()
+	select {
+	case err := <-errs:
+		if err != ErrClosed {
+			t.Fatalf("read: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read still blocked")
+	}
+}
+
+// Meant for go test -race.
+func TestConcurrent(t *testing.T) {
+	client, server := pair(t)
+	go io.Copy(io.Discard, server)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for {
+				if _, err := client.Write([]byte("ping")); err != nil {
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for {
+				client.SetReadDeadline(time.Now().Add(time.Millisecond))
+				if _, err := client.Read(make([]byte, 8)); err == ErrClosed {
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	go client.Close()
+	client.Close()
+	wg.Wait()
+}
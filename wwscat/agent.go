@@ -0,0 +1,152 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/wegel/wwscc/wwsclient"
+)
+
+// In agent mode (--agent), wwscat stays connected to the connector under a
+// stable name, and proxies every channel the connector hands it. Each channel
+// is served by a copy of ourselves, started with the same flags and
+// agentChannelEnv set to the channel ID, which makes it a regular proxy for
+// that channel.
+const agentChannelEnv = "WWS_AGENT_CHANNEL"
+
+const (
+	// The connector pings agents every few seconds; without any for this
+	// long, the connection is considered dead and we reconnect.
+	agentTimeout = 30 * time.Second
+	// Longest wait between two reconnection attempts.
+	maxAgentBackoff = time.Minute
+)
+
+// runAgent keeps the agent connected, until another agent takes our name or
+// the connector refuses our credentials. While an agent with other
+// credentials holds the name, we keep trying.
+func runAgent(base *url.URL) error {
+	header := parseHeaders(*headers)
+	if len(*agentToken) > 0 {
+		token, err := ioutil.ReadFile(*agentToken)
+		if err != nil {
+			return err
+		}
+		header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	wait := time.Second
+	for {
+		started := time.Now()
+		err := serveAgent(agentURL(base), header)
+		if ce, ok := err.(*websocket.CloseError); ok && ce.Code == wwsclient.CloseAgentReplaced {
+			return &wwsclient.CloseError{Code: ce.Code, Reason: ce.Text}
+		}
+		if err == errAgentRefused {
+			return err
+		}
+		if time.Since(started) > maxAgentBackoff {
+			wait = time.Second
+		}
+		log.Printf("Agent connection lost (%v), reconnecting in %v", err, wait)
+		time.Sleep(wait)
+		if wait *= 2; wait > maxAgentBackoff {
+			wait = maxAgentBackoff
+		}
+	}
+}
+
+var errAgentRefused = errors.New("the connector refused the agent, check --agent-token-file")
+
+func serveAgent(url string, header http.Header) error {
+	ws, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if resp != nil && resp.StatusCode == http.StatusForbidden {
+		return errAgentRefused
+	}
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	ws.SetReadDeadline(time.Now().Add(agentTimeout))
+	ws.SetPingHandler(func(data string) error {
+		ws.SetReadDeadline(time.Now().Add(agentTimeout))
+		return ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(agentTimeout))
+	})
+	log.Printf("Agent %s online", *agentName)
+
+	for {
+		messageType, buf, err := ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if messageType != websocket.TextMessage {
+			continue
+		}
+
+		var msg wwsclient.ControlMessage
+		if err := json.Unmarshal(buf, &msg); err != nil || msg.Type != wwsclient.ControlAttach {
+			log.Println("Ignoring unexpected message from the connector")
+			continue
+		}
+		if _, err := uuid.Parse(msg.Channel); err != nil {
+			log.Println("Ignoring invalid channel ID", msg.Channel)
+			continue
+		}
+		go attach(msg.Channel)
+	}
+}
+
+// attach serves a channel, in a copy of ourselves.
+func attach(channel string) {
+	log.Println("Attaching to channel", channel)
+	self, err := os.Executable()
+	if err != nil {
+		log.Println("Couldn't find our executable:", err)
+		return
+	}
+
+	cmd := exec.Command(self, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), agentChannelEnv+"="+channel)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	log.Printf("Channel %s ended: %v", channel, err)
+}
+
+// agentURL is where the agent registers, labels in the query string.
+func agentURL(base *url.URL) string {
+	labels := url.Values{}
+	labels.Set("hostname", hostname())
+	labels.Set("os", runtime.GOOS)
+	for key, value := range *agentLabels {
+		labels.Set(key, value)
+	}
+
+	u := *base
+	u.Path = path.Join(u.Path, "/ws/agent", *agentName)
+	u.RawQuery = labels.Encode()
+	return u.String()
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return name
+}
@@ -0,0 +1,77 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+
+	"github.com/gorilla/websocket"
+	"github.com/wegel/wwscc/wwsclient"
+)
+
+// Exit statuses telling scripts why the channel closed, mostly borrowed from
+// sysexits.h. When the connector ran an ssh session for us, we exit with the
+// session's own exit status instead, like ssh does.
+const (
+	exitNormal         = 0
+	exitError          = 1  // anything not covered below
+	exitChannelUnknown = 68 // EX_NOHOST
+	exitPeerLost       = 69 // EX_UNAVAILABLE, the other side dropped
+	exitGoingAway      = 75 // EX_TEMPFAIL, the connector is restarting, reconnect
+	exitSSHFailed      = 76 // EX_PROTOCOL
+	exitAuthFailed     = 77 // EX_NOPERM
+	exitAgentReplaced  = 78 // EX_CONFIG, another agent uses our name
+	exitTimeout        = 79 // the other side stopped responding
+	exitNotShared      = 80 // the ssh session can't be watched
+	exitHopFailed      = 81 // couldn't reach the next connector of a chain
+)
+
+// exit ends wwscat with a status telling why the channel closed.
+func exit(err error) {
+	if listener != nil {
+		listener.Close()
+	}
+	if err == nil || err == io.EOF {
+		log.Println("Channel closed")
+		os.Exit(exitNormal)
+	}
+	ce, ok := err.(*wwsclient.CloseError)
+	if !ok {
+		log.Println(err)
+		os.Exit(exitError)
+	}
+
+	if len(ce.Reason) > 0 {
+		log.Printf("Channel closed: %s (%d)", ce.Reason, ce.Code)
+	} else {
+		log.Printf("Channel closed (%d)", ce.Code)
+	}
+
+	switch {
+	case ce.Code == websocket.CloseNormalClosure:
+		os.Exit(exitNormal)
+	case ce.Code == websocket.CloseGoingAway:
+		os.Exit(exitGoingAway)
+	case ce.Code == wwsclient.CloseTimeout:
+		os.Exit(exitTimeout)
+	case ce.Code == wwsclient.ClosePeerLost || ce.Code == websocket.CloseAbnormalClosure:
+		os.Exit(exitPeerLost)
+	case ce.Code == wwsclient.CloseChannelUnknown:
+		os.Exit(exitChannelUnknown)
+	case ce.Code == wwsclient.CloseAuthFailed:
+		os.Exit(exitAuthFailed)
+	case ce.Code == wwsclient.CloseSSHFailed:
+		os.Exit(exitSSHFailed)
+	case ce.Code == wwsclient.CloseAgentReplaced:
+		os.Exit(exitAgentReplaced)
+	case ce.Code == wwsclient.CloseNotShared:
+		os.Exit(exitNotShared)
+	case ce.Code == wwsclient.CloseHopFailed:
+		os.Exit(exitHopFailed)
+	case ce.Code >= wwsclient.CloseExitStatus && ce.Code <= wwsclient.CloseExitStatus+255:
+		os.Exit(ce.Code - wwsclient.CloseExitStatus)
+	}
+	os.Exit(exitError)
+}
@@ -0,0 +1,282 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/wegel/wwscc/wwsclient"
+)
+
+// Reverse forwarding: the side running --reverse-listen accepts connections,
+// and each one becomes a stream carried back to the side running
+// --reverse-target, which dials the target for it. Streams share the channel:
+// data goes in binary frames prefixed with the stream ID (like UDP flows), and
+// streams are opened and closed with control messages.
+//
+// Each stream has its own queue of data for its conn, written (and dialed)
+// by its own goroutine, so that a slow or unreachable target only holds up
+// its own stream. Senders keep at most streamWindow data frames of a stream
+// in flight, until the other side acks them once written to the conn: the
+// queue never fills up, and a slow conn slows its stream down rather than
+// losing data. A peer that overruns the window gets its stream closed.
+
+// Data frames of a stream in flight, and its queue.
+const streamWindow = 64
+
+// Acks are sent once the queue is drained, or after that many frames.
+const ackEvery = streamWindow / 4
+
+type streams struct {
+	ws    messageConn
+	wmu   sync.Mutex
+	mu    sync.Mutex
+	conns map[uint32]*stream
+}
+
+type stream struct {
+	id     uint32
+	writes chan []byte   // closed once the stream is removed
+	window chan struct{} // one per frame sent and not acked yet
+	done   chan struct{} // closed once the stream is removed
+}
+
+func newStreams(ws messageConn) *streams {
+	return &streams{ws: ws, conns: make(map[uint32]*stream)}
+}
+
+func serveReverseListen(ws messageConn, l net.Listener) error {
+	s := newStreams(ws)
+	go func() {
+		var lastID uint32
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Fatalln("Error accepting:", err)
+			}
+
+			lastID++
+			log.Printf("Opening stream %d for %s", lastID, conn.RemoteAddr().String())
+			st := s.add(lastID, conn, nil)
+			if err := s.control(wwsclient.ControlMessage{Type: wwsclient.ControlOpen, ID: lastID}); err != nil {
+				log.Fatalln("Error while writing to ws:", err)
+			}
+			go s.pump(st, conn)
+		}
+	}()
+
+	return s.serve(nil)
+}
+
+func serveReverseTarget(ws messageConn, network, address string) error {
+	s := newStreams(ws)
+	return s.serve(func(id uint32) {
+		// the stream exists before any of its data frames get delivered,
+		// they wait in its queue while dialing
+		s.add(id, nil, func() (net.Conn, error) {
+			conn, err := net.Dial(network, address)
+			if err == nil {
+				log.Printf("Opened stream %d to %s", id, address)
+			}
+			return conn, err
+		})
+	})
+}
+
+// add starts the stream, dialing its conn with dial if it's nil. The caller
+// pumps a conn it passes.
+func (s *streams) add(id uint32, conn net.Conn, dial func() (net.Conn, error)) *stream {
+	st := &stream{
+		id:     id,
+		writes: make(chan []byte, streamWindow),
+		window: make(chan struct{}, streamWindow),
+		done:   make(chan struct{}),
+	}
+	s.mu.Lock()
+	s.conns[id] = st
+	s.mu.Unlock()
+	go s.write(st, conn, dial)
+	return st
+}
+
+// remove forgets the stream, and reports whether it was still open.
+func (s *streams) remove(id uint32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.removeLocked(id)
+}
+
+func (s *streams) removeLocked(id uint32) bool {
+	st, ok := s.conns[id]
+	if ok {
+		delete(s.conns, id)
+		close(st.writes)
+		close(st.done)
+	}
+	return ok
+}
+
+// deliver queues data for the stream, closing it if the other side sent
+// more than the window.
+func (s *streams) deliver(id uint32, data []byte) {
+	s.mu.Lock()
+	st := s.conns[id]
+	if st == nil {
+		s.mu.Unlock()
+		return
+	}
+	select {
+	case st.writes <- data:
+		s.mu.Unlock()
+		return
+	default:
+	}
+	s.removeLocked(id)
+	s.mu.Unlock()
+
+	log.Printf("Stream %d overran its window, closing it", id)
+	s.control(wwsclient.ControlMessage{Type: wwsclient.ControlClose, ID: id})
+}
+
+func (s *streams) writeMessage(messageType int, buf []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return s.ws.WriteMessage(messageType, buf)
+}
+
+func (s *streams) control(msg wwsclient.ControlMessage) error {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.writeMessage(websocket.TextMessage, buf)
+}
+
+// write copies the stream's queue to its conn, dialing it first if needed,
+// and closes the conn once the stream is removed.
+func (s *streams) write(st *stream, conn net.Conn, dial func() (net.Conn, error)) {
+	if conn == nil {
+		var err error
+		if conn, err = dial(); err != nil {
+			log.Printf("Error dialing for stream %d: %v", st.id, err)
+			if s.remove(st.id) {
+				s.control(wwsclient.ControlMessage{Type: wwsclient.ControlClose, ID: st.id})
+			}
+			for range st.writes {
+			}
+			return
+		}
+		go s.pump(st, conn)
+	}
+
+	failed := false
+	written := 0
+	for data := range st.writes {
+		if failed {
+			continue
+		}
+		if _, err := conn.Write(data); err != nil {
+			// the pump fails too, and closes the stream
+			failed = true
+			conn.Close()
+			continue
+		}
+		if written++; written >= ackEvery || len(st.writes) == 0 {
+			s.control(wwsclient.ControlMessage{Type: wwsclient.ControlAck, ID: st.id, Count: written})
+			written = 0
+		}
+	}
+	conn.Close()
+}
+
+// ack makes room in the stream's window.
+func (s *streams) ack(id uint32, count int) {
+	s.mu.Lock()
+	st := s.conns[id]
+	s.mu.Unlock()
+	if st == nil {
+		return
+	}
+	for ; count > 0; count-- {
+		select {
+		case <-st.window:
+		default:
+			// more than was sent
+			return
+		}
+	}
+}
+
+// conn -> ws, until either end closes the stream, waiting for acks once the
+// window is full
+func (s *streams) pump(st *stream, conn net.Conn) {
+	id := st.id
+	buf := make([]byte, flowHeaderLen+64*1024)
+	binary.BigEndian.PutUint32(buf, id)
+	for {
+		n, err := conn.Read(buf[flowHeaderLen:])
+		if n > 0 {
+			select {
+			case st.window <- struct{}{}:
+			case <-st.done:
+				// closed by the other side
+				return
+			}
+			if err := s.writeMessage(websocket.BinaryMessage, buf[:flowHeaderLen+n]); err != nil {
+				log.Fatalln("Error while writing to ws:", err)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	// false if the other side closed the stream first; the writer closes
+	// the conn once it wrote what's queued
+	if s.remove(id) {
+		log.Printf("Closing stream %d", id)
+		s.control(wwsclient.ControlMessage{Type: wwsclient.ControlClose, ID: id})
+	}
+}
+
+// ws -> streams, until the channel closes
+func (s *streams) serve(open func(id uint32)) error {
+	for {
+		messageType, buf, err := s.ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		switch messageType {
+		case websocket.BinaryMessage:
+			if len(buf) < flowHeaderLen {
+				continue
+			}
+			s.deliver(binary.BigEndian.Uint32(buf), buf[flowHeaderLen:])
+
+		case websocket.TextMessage:
+			var msg wwsclient.ControlMessage
+			if err := json.Unmarshal(buf, &msg); err != nil {
+				log.Println("Ignoring malformed control message:", err)
+				continue
+			}
+			switch msg.Type {
+			case wwsclient.ControlOpen:
+				if open != nil {
+					open(msg.ID)
+				}
+			case wwsclient.ControlAck:
+				s.ack(msg.ID, msg.Count)
+			case wwsclient.ControlClose:
+				if s.remove(msg.ID) {
+					log.Printf("Stream %d closed by the other side", msg.ID)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/wegel/wwscc/wwsclient"
+)
+
+type message struct {
+	messageType int
+	data        []byte
+}
+
+// fakeWS is a channel, read from in and written to out.
+type fakeWS struct {
+	in   chan message
+	out  chan message
+	fail error // returned by WriteMessage, if set
+}
+
+func newFakeWS() *fakeWS {
+	return &fakeWS{in: make(chan message), out: make(chan message, 256)}
+}
+
+func (f *fakeWS) ReadMessage() (int, []byte, error) {
+	m, ok := <-f.in
+	if !ok {
+		return 0, nil, io.EOF
+	}
+	return m.messageType, m.data, nil
+}
+
+func (f *fakeWS) WriteMessage(messageType int, data []byte) error {
+	if f.fail != nil {
+		return f.fail
+	}
+	f.out <- message{messageType, append([]byte(nil), data...)}
+	return nil
+}
+
+func (f *fakeWS) Close() error { return nil }
+
+func (f *fakeWS) send(id uint32, data string) {
+	buf := make([]byte, flowHeaderLen+len(data))
+	binary.BigEndian.PutUint32(buf, id)
+	copy(buf[flowHeaderLen:], data)
+	f.in <- message{websocket.BinaryMessage, buf}
+}
+
+// waitClose waits for the stream to be closed on the channel.
+func (f *fakeWS) waitClose(t *testing.T, id uint32) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case m := <-f.out:
+			var msg wwsclient.ControlMessage
+			if m.messageType == websocket.TextMessage && json.Unmarshal(m.data, &msg) == nil &&
+				msg.Type == wwsclient.ControlClose && msg.ID == id {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("stream %d not closed", id)
+		}
+	}
+}
+
+// ack acks count frames of the stream, as the other side.
+func (f *fakeWS) ack(id uint32, count int) {
+	buf, _ := json.Marshal(wwsclient.ControlMessage{Type: wwsclient.ControlAck, ID: id, Count: count})
+	f.in <- message{websocket.TextMessage, buf}
+}
+
+// next waits for a message sent about the stream.
+func (f *fakeWS) next(t *testing.T, id uint32) (data []byte, msg wwsclient.ControlMessage) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case m := <-f.out:
+			if m.messageType == websocket.BinaryMessage && binary.BigEndian.Uint32(m.data) == id {
+				return m.data[flowHeaderLen:], msg
+			}
+			if m.messageType == websocket.TextMessage && json.Unmarshal(m.data, &msg) == nil && msg.ID == id {
+				return nil, msg
+			}
+		case <-timeout:
+			t.Fatalf("nothing sent for stream %d", id)
+		}
+	}
+}
+
+func TestStreamsSlowStream(t *testing.T) {
+	ws := newFakeWS()
+	s := newStreams(ws)
+	go s.serve(nil)
+	defer close(ws.in)
+
+	// not read for a while, then slowly
+	slow, slowPeer := net.Pipe()
+	defer slowPeer.Close()
+	s.add(1, slow, nil)
+	const frames = 4 * streamWindow
+	received := make(chan string)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		var got []byte
+		buf := make([]byte, 3)
+		for len(got) < frames*4 {
+			n, err := slowPeer.Read(buf)
+			if err != nil {
+				break
+			}
+			got = append(got, buf[:n]...)
+		}
+		received <- string(got)
+	}()
+
+	// sent keeping to the window: the stream is throttled, not closed
+	var want []byte
+	inFlight := 0
+	for i := 0; i < frames; i++ {
+		for inFlight == streamWindow {
+			_, msg := ws.next(t, 1)
+			if msg.Type != wwsclient.ControlAck {
+				t.Fatalf("got %q, want an ack", msg.Type)
+			}
+			inFlight -= msg.Count
+		}
+		data := fmt.Sprintf("%04d", i)
+		ws.send(1, data)
+		want = append(want, data...)
+		inFlight++
+	}
+	select {
+	case got := <-received:
+		if got != string(want) {
+			t.Errorf("got %d bytes of %d, or out of order", len(got), len(want))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not all delivered")
+	}
+}
+
+func TestStreamsWindow(t *testing.T) {
+	ws := newFakeWS()
+	s := newStreams(ws)
+	go s.serve(nil)
+	defer close(ws.in)
+
+	local, peer := net.Pipe()
+	defer peer.Close()
+	st := s.add(1, local, nil)
+	go s.pump(st, local)
+	go func() {
+		for i := 0; i < 2*streamWindow; i++ {
+			peer.Write([]byte("x"))
+		}
+	}()
+
+	// up to the window, then nothing until acked
+	for i := 0; i < streamWindow; i++ {
+		if data, msg := ws.next(t, 1); string(data) != "x" {
+			t.Fatalf("got %q %q, want data", data, msg.Type)
+		}
+	}
+	select {
+	case m := <-ws.out:
+		t.Fatalf("sent %q past the window", m.data)
+	case <-time.After(50 * time.Millisecond):
+	}
+	ws.ack(1, streamWindow)
+	for i := 0; i < streamWindow; i++ {
+		if data, msg := ws.next(t, 1); string(data) != "x" {
+			t.Fatalf("got %q %q, want data", data, msg.Type)
+		}
+	}
+}
+
+func TestStreamsUnreachableTarget(t *testing.T) {
+	// a port nothing listens on anymore
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	ws := newFakeWS()
+	go serveReverseTarget(ws, "tcp", address)
+	defer close(ws.in)
+
+	open, _ := json.Marshal(wwsclient.ControlMessage{Type: wwsclient.ControlOpen, ID: 7})
+	ws.in <- message{websocket.TextMessage, open}
+	ws.send(7, "dropped")
+	ws.waitClose(t, 7)
+}
@@ -13,13 +13,11 @@ type StdioConn struct {
 	addr net.Addr
 }
 
-func NewStdioConn(ready chan<- struct{}) (conn *StdioConn, err error) {
+func NewStdioConn() *StdioConn {
 	addr, _ := net.ResolveTCPAddr("tcp", "localhost")
-	conn = &StdioConn{
+	return &StdioConn{
 		addr: addr,
 	}
-	ready <- struct{}{}
-	return
 }
 
 func (conn *StdioConn) Read(b []byte) (n int, err error) {
@@ -30,6 +28,11 @@ func (conn *StdioConn) Write(b []byte) (n int, err error) {
 	return os.Stdout.Write(b)
 }
 
+// CloseWrite closes stdout, for whoever reads it to see the end.
+func (conn *StdioConn) CloseWrite() error {
+	return os.Stdout.Close()
+}
+
 func (conn *StdioConn) Close() error {
 	return nil
 }
@@ -0,0 +1,214 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// UDP datagrams travel one per binary websocket message, prefixed with a
+// flow ID so replies find their way back to the client that sent the request.
+// A flow is a local client address on the tunnel side, and a socket connected
+// to the target on the proxy side. Both ends forget idle flows on their own.
+const (
+	flowHeaderLen = 4
+	maxDatagram   = 64 * 1024
+)
+
+type udpFlow struct {
+	addr     *net.UDPAddr // tunnel side: the local client
+	conn     *net.UDPConn // proxy side: our socket to the target
+	lastSeen time.Time
+}
+
+// local UDP clients <-> ws, until either fails
+func serveUDPListen(ws messageConn, l *net.UDPConn, timeout time.Duration) error {
+	defer l.Close()
+
+	var mu sync.Mutex
+	ids := make(map[string]uint32)
+	flows := make(map[uint32]*udpFlow)
+	var lastID uint32
+
+	done := make(chan struct{})
+	defer close(done)
+	go expireFlows(&mu, flows, timeout, done, func(id uint32, flow *udpFlow) {
+		delete(ids, flow.addr.String())
+	})
+
+	errs := make(chan error, 2)
+	go func() {
+		buf := make([]byte, flowHeaderLen+maxDatagram)
+		for {
+			n, from, err := l.ReadFromUDP(buf[flowHeaderLen:])
+			if err != nil {
+				errs <- fmt.Errorf("reading UDP: %v", err)
+				return
+			}
+
+			mu.Lock()
+			id, ok := ids[from.String()]
+			if !ok {
+				lastID++
+				id = lastID
+				ids[from.String()] = id
+				flows[id] = &udpFlow{addr: from}
+				log.Printf("New UDP flow %d from %s", id, from.String())
+			}
+			flows[id].lastSeen = time.Now()
+			mu.Unlock()
+
+			binary.BigEndian.PutUint32(buf, id)
+			if err := ws.WriteMessage(websocket.BinaryMessage, buf[:flowHeaderLen+n]); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			messageType, buf, err := ws.ReadMessage()
+			if err != nil {
+				errs <- err
+				return
+			}
+			if messageType != websocket.BinaryMessage || len(buf) < flowHeaderLen {
+				continue
+			}
+
+			id := binary.BigEndian.Uint32(buf)
+			mu.Lock()
+			flow := flows[id]
+			if flow != nil {
+				flow.lastSeen = time.Now()
+			}
+			mu.Unlock()
+
+			if flow == nil {
+				// the client went quiet and was forgotten, nowhere to send this
+				continue
+			}
+			if _, err := l.WriteToUDP(buf[flowHeaderLen:], flow.addr); err != nil {
+				log.Println("Error writing UDP to", flow.addr.String(), err)
+			}
+		}
+	}()
+
+	return <-errs
+}
+
+// ws <-> UDP target, one socket per flow, until the channel or a write to
+// it fails
+func serveUDPProxy(ws messageConn, addr *net.UDPAddr, timeout time.Duration) error {
+	var mu sync.Mutex
+	var wmu sync.Mutex
+	flows := make(map[uint32]*udpFlow)
+
+	done := make(chan struct{})
+	go expireFlows(&mu, flows, timeout, done, func(id uint32, flow *udpFlow) {
+		flow.conn.Close()
+	})
+	defer func() {
+		close(done)
+		mu.Lock()
+		for _, flow := range flows {
+			flow.conn.Close()
+		}
+		mu.Unlock()
+	}()
+
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			messageType, buf, err := ws.ReadMessage()
+			if err != nil {
+				errs <- err
+				return
+			}
+			if messageType != websocket.BinaryMessage || len(buf) < flowHeaderLen {
+				continue
+			}
+
+			id := binary.BigEndian.Uint32(buf)
+			mu.Lock()
+			flow := flows[id]
+			if flow == nil {
+				conn, err := net.DialUDP("udp", nil, addr)
+				if err != nil {
+					mu.Unlock()
+					log.Println("Error dialing UDP target:", err)
+					continue
+				}
+				log.Printf("New UDP flow %d to %s", id, addr.String())
+				flow = &udpFlow{conn: conn}
+				flows[id] = flow
+				go udpReplies(ws, &wmu, &mu, id, flow, errs)
+			}
+			flow.lastSeen = time.Now()
+			mu.Unlock()
+
+			if _, err := flow.conn.Write(buf[flowHeaderLen:]); err != nil {
+				log.Println("Error writing UDP to", addr.String(), err)
+			}
+		}
+	}()
+
+	return <-errs
+}
+
+// target -> ws, until the flow expires and its socket is closed, or writing
+// to ws fails
+func udpReplies(ws messageConn, wmu *sync.Mutex, mu *sync.Mutex, id uint32, flow *udpFlow, errs chan<- error) {
+	buf := make([]byte, flowHeaderLen+maxDatagram)
+	binary.BigEndian.PutUint32(buf, id)
+	for {
+		n, err := flow.conn.Read(buf[flowHeaderLen:])
+		if err != nil {
+			return
+		}
+
+		mu.Lock()
+		flow.lastSeen = time.Now()
+		mu.Unlock()
+
+		wmu.Lock()
+		err = ws.WriteMessage(websocket.BinaryMessage, buf[:flowHeaderLen+n])
+		wmu.Unlock()
+		if err != nil {
+			select {
+			case errs <- err:
+			default:
+			}
+			return
+		}
+	}
+}
+
+func expireFlows(mu *sync.Mutex, flows map[uint32]*udpFlow, timeout time.Duration, done <-chan struct{}, expire func(uint32, *udpFlow)) {
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			mu.Lock()
+			for id, flow := range flows {
+				if now.Sub(flow.lastSeen) > timeout {
+					log.Printf("UDP flow %d idle, forgetting it", id)
+					expire(id, flow)
+					delete(flows, id)
+				}
+			}
+			mu.Unlock()
+		case <-done:
+			return
+		}
+	}
+}
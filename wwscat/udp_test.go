@@ -0,0 +1,173 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func listenUDP(t *testing.T) *net.UDPConn {
+	t.Helper()
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func dialUDP(t *testing.T, addr net.Addr) *net.UDPConn {
+	t.Helper()
+	conn, err := net.DialUDP("udp", nil, addr.(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// nextFlow waits for a datagram sent on the channel.
+func (f *fakeWS) nextFlow(t *testing.T) (id uint32, data string) {
+	t.Helper()
+	select {
+	case m := <-f.out:
+		if m.messageType != websocket.BinaryMessage || len(m.data) < flowHeaderLen {
+			t.Fatalf("sent %d %q", m.messageType, m.data)
+		}
+		return binary.BigEndian.Uint32(m.data), string(m.data[flowHeaderLen:])
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing sent")
+	}
+	return
+}
+
+func readUDP(t *testing.T, conn *net.UDPConn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestUDPListenFlows(t *testing.T) {
+	ws := newFakeWS()
+	l := listenUDP(t)
+	go serveUDPListen(ws, l, time.Minute)
+	defer close(ws.in)
+
+	a, b := dialUDP(t, l.LocalAddr()), dialUDP(t, l.LocalAddr())
+	a.Write([]byte("from a"))
+	idA, data := ws.nextFlow(t)
+	if data != "from a" {
+		t.Fatalf("sent %q", data)
+	}
+	b.Write([]byte("from b"))
+	idB, data := ws.nextFlow(t)
+	if data != "from b" || idB == idA {
+		t.Fatalf("sent %q on flow %d, a is on %d", data, idB, idA)
+	}
+	// the same client keeps its flow
+	a.Write([]byte("again"))
+	if id, _ := ws.nextFlow(t); id != idA {
+		t.Fatalf("a moved to flow %d from %d", id, idA)
+	}
+
+	// replies go back to whoever sent on the flow
+	ws.send(idB, "to b")
+	ws.send(idA, "to a")
+	if got := readUDP(t, a); got != "to a" {
+		t.Errorf("a got %q", got)
+	}
+	if got := readUDP(t, b); got != "to b" {
+		t.Errorf("b got %q", got)
+	}
+}
+
+func TestUDPListenExpiry(t *testing.T) {
+	ws := newFakeWS()
+	l := listenUDP(t)
+	go serveUDPListen(ws, l, 50*time.Millisecond)
+	defer close(ws.in)
+
+	a := dialUDP(t, l.LocalAddr())
+	a.Write([]byte("before"))
+	id, _ := ws.nextFlow(t)
+	time.Sleep(200 * time.Millisecond)
+
+	// forgotten: a late reply goes nowhere, and the client gets a new flow
+	ws.send(id, "late")
+	a.Write([]byte("after"))
+	if newID, _ := ws.nextFlow(t); newID == id {
+		t.Errorf("still on flow %d", id)
+	}
+	a.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := a.Read(make([]byte, 64)); err == nil {
+		t.Errorf("got a reply of %d bytes on an expired flow", n)
+	}
+}
+
+func TestUDPProxyFlows(t *testing.T) {
+	// echoes back with the sender's address, to tell the flow sockets apart
+	target := listenUDP(t)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, from, err := target.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			target.WriteToUDP(append(buf[:n:n], " "+from.String()...), from)
+		}
+	}()
+
+	ws := newFakeWS()
+	errs := make(chan error, 1)
+	go func() { errs <- serveUDPProxy(ws, target.LocalAddr().(*net.UDPAddr), time.Minute) }()
+
+	replies := make(map[uint32]string)
+	for _, id := range []uint32{7, 9} {
+		ws.send(id, "ping")
+		got, data := ws.nextFlow(t)
+		if got != id {
+			t.Fatalf("reply to flow %d on flow %d", id, got)
+		}
+		replies[id] = data
+	}
+	if replies[7] == replies[9] {
+		t.Errorf("both flows went through the same socket: %q", replies[7])
+	}
+
+	close(ws.in)
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("still serving after the channel closed")
+	}
+}
+
+func TestUDPWriteError(t *testing.T) {
+	ws := newFakeWS()
+	ws.fail = errors.New("channel gone")
+	l := listenUDP(t)
+	errs := make(chan error, 1)
+	go func() { errs <- serveUDPListen(ws, l, time.Minute) }()
+
+	dialUDP(t, l.LocalAddr()).Write([]byte("x"))
+	select {
+	case err := <-errs:
+		if err != ws.fail {
+			t.Errorf("returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write error not returned")
+	}
+}
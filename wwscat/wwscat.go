@@ -3,110 +3,231 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 
-	"net"
-
-	"github.com/gorilla/websocket"
+	"github.com/wegel/wwscc/config"
+	"github.com/wegel/wwscc/wwsclient"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 var (
-	listenAddr = kingpin.Flag("listen", "Listen to this TCP host:port (instead of stdio)").Default("").OverrideDefaultFromEnvar("WWS_TCP_LISTEN").Short('l').TCP()
-	proxyAddr  = kingpin.Flag("proxy", "Proxy to this TCP host:port").Default("").OverrideDefaultFromEnvar("PROXY").Short('p').TCP()
-	wsURL      = kingpin.Arg("url", "URL of the websocket server").Required().URL()
+	configFile  = kingpin.Flag("config", "Read settings from this YAML file").Default("").OverrideDefaultFromEnvar("WWS_CONFIG").String()
+	listenAddr  = kingpin.Flag("listen", "Listen to this TCP host:port or unix:/path (instead of stdio)").Default("").OverrideDefaultFromEnvar("WWS_TCP_LISTEN").Short('l').String()
+	socketMode  = kingpin.Flag("socket-mode", "Octal file mode of the unix socket created by --listen").Default("").OverrideDefaultFromEnvar("WWS_SOCKET_MODE").String()
+	proxyAddr   = kingpin.Flag("proxy", "Proxy to this TCP host:port, unix:/path, or channel on another connector (ws:// or wss:// tunnel URL)").Default("").OverrideDefaultFromEnvar("PROXY").Short('p').String()
+	allowFile   = kingpin.Flag("allow", "Policy file of destinations the tunnel side may request (proxy mode)").Default("").OverrideDefaultFromEnvar("WWS_ALLOW").Short('a').String()
+	udpListen   = kingpin.Flag("udp-listen", "Listen to this UDP host:port and forward datagrams").Default("").OverrideDefaultFromEnvar("WWS_UDP_LISTEN").String()
+	udpProxy    = kingpin.Flag("udp-proxy", "Forward datagrams to this UDP host:port").Default("").OverrideDefaultFromEnvar("WWS_UDP_PROXY").String()
+	udpTimeout  = kingpin.Flag("udp-timeout", "Forget UDP flows idle for this long").Default("60s").OverrideDefaultFromEnvar("WWS_UDP_TIMEOUT").Duration()
+	revListen   = kingpin.Flag("reverse-listen", "Listen to this TCP host:port or unix:/path and carry each connection back to the other side").Default("").OverrideDefaultFromEnvar("WWS_REVERSE_LISTEN").String()
+	revTarget   = kingpin.Flag("reverse-target", "Dial this TCP host:port or unix:/path for connections carried back from the other side").Default("").OverrideDefaultFromEnvar("WWS_REVERSE_TARGET").String()
+	pskFile     = kingpin.Flag("psk-file", "Encrypt end-to-end with the secret in this file, shared with the other side").Default("").OverrideDefaultFromEnvar("WWS_PSK_FILE").String()
+	keyFile     = kingpin.Flag("key-file", "Encrypt end-to-end with our private key from this file (created if missing)").Default("").OverrideDefaultFromEnvar("WWS_KEY_FILE").String()
+	peerKey     = kingpin.Flag("peer-key", "Hex public key the other side must prove it holds (with --key-file)").Default("").OverrideDefaultFromEnvar("WWS_PEER_KEY").String()
+	compress    = kingpin.Flag("compress", "Ask for per-message compression").Default("false").OverrideDefaultFromEnvar("WWS_COMPRESS").Bool()
+	compressMin = kingpin.Flag("compress-threshold", "Don't compress messages smaller than this many bytes").Default("256").OverrideDefaultFromEnvar("WWS_COMPRESS_THRESHOLD").Int()
+	agentName   = kingpin.Flag("agent", "Stay connected as an agent with this name, proxying the channels created for it").Default("").OverrideDefaultFromEnvar("WWS_AGENT").String()
+	agentToken  = kingpin.Flag("agent-token-file", "The agent authenticates with the token in this file").Default("").OverrideDefaultFromEnvar("WWS_AGENT_TOKEN_FILE").String()
+	agentLabels = kingpin.Flag("label", "Label announced by the agent, as key=value (repeatable)").StringMap()
+	headers     = kingpin.Flag("header", "Header sent to the connector, as 'Name: value' (repeatable)").Strings()
+	proxyHeader = kingpin.Flag("proxy-header", "Header sent to the connector of a ws:// or wss:// --proxy, as 'Name: value' (repeatable)").Strings()
+	target      = kingpin.Flag("target", "Ask the proxy to connect to this host:port or unix:/path (tunnel mode)").Default("").OverrideDefaultFromEnvar("WWS_TARGET").Short('t').String()
+	wsURL       = kingpin.Arg("url", "URL of the websocket server (of the connector itself with --agent)").Required().URL()
 )
 
+// listener is closed on exit, which removes its unix socket.
+var listener net.Listener
+
+// messageConn is the message level side of a channel, for the modes carrying
+// several flows or streams on it.
+type messageConn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	Close() error
+}
+
 func main() {
+	if path := config.Path(os.Args[1:], "WWS_CONFIG"); len(path) > 0 {
+		kingpin.FatalIfError(config.Load(kingpin.CommandLine, path), "Couldn't load config")
+	}
 	kingpin.Parse()
 
-	ws := connect((*wsURL).String())
+	if len(*agentName) > 0 {
+		if len(*proxyAddr) == 0 && len(*allowFile) == 0 && len(*udpProxy) == 0 && len(*revTarget) == 0 {
+			kingpin.Fatalf("--agent needs --proxy, --allow, --udp-proxy or --reverse-target")
+		}
+		if channel := os.Getenv(agentChannelEnv); len(channel) > 0 {
+			*wsURL = wwsclient.ChannelURL(*wsURL, "proxy", channel)
+		} else {
+			exit(runAgent(*wsURL))
+		}
+	}
+
+	ws := connect((*wsURL).String(), options())
 	trapCtrlC(ws)
+	ctx := context.Background()
 
-	var conn net.Conn
-	var err error
+	if len(*udpListen) > 0 || len(*udpProxy) > 0 {
+		exit(forwardUDP(ws))
+	}
+
+	if len(*revListen) > 0 {
+		log.Println("Setupping reverse listener on ", *revListen)
+		l, err := wwsclient.Listen(*revListen, fileMode())
+		kingpin.FatalIfError(err, "Couldn't listen")
+		listener = l
+		exit(serveReverseListen(ws, l))
+	} else if len(*revTarget) > 0 {
+		network, address := wwsclient.SplitAddr(*revTarget)
+		log.Println("Setupping reverse target", network, address)
+		exit(serveReverseTarget(ws, network, address))
+	}
 
-	ready := make(chan struct{}, 1)
+	if len(*listenAddr) > 0 {
+		log.Println("Setupping listener on ", *listenAddr)
+		l, err := wwsclient.Listen(*listenAddr, fileMode())
+		kingpin.FatalIfError(err, "Couldn't listen")
+		listener = l
+		exit(wwsclient.ServeListener(ctx, l, ws))
+	} else if len(*proxyAddr) > 0 || len(*allowFile) > 0 {
+		if len(*proxyAddr) > 0 {
+			log.Println("Setupping proxy to ", *proxyAddr)
+		}
 
-	if *listenAddr != nil && (*listenAddr).Port != 0 {
-		log.Println("Setupping TCP listener on ", (*listenAddr).String())
-		conn, err = tcpConn(*listenAddr, ready)
-	} else if *proxyAddr != nil && (*proxyAddr).Port != 0 {
-		log.Println("Setupping TCP proxy to ", (*proxyAddr).String())
-		conn, err = NewCOWConn((*proxyAddr).String(), ready)
+		var policy *wwsclient.Policy
+		if len(*allowFile) > 0 {
+			var err error
+			policy, err = wwsclient.LoadPolicy(*allowFile)
+			kingpin.FatalIfError(err, "Couldn't load destination policy")
+			log.Println("Accepting destinations allowed by", *allowFile)
+		}
+		exit(wwsclient.Proxy(ctx, ws, *proxyAddr, policy))
 	} else {
-		conn, err = NewStdioConn(ready)
+		ws.OnControl = func(msg wwsclient.ControlMessage) {
+			if msg.Type == wwsclient.ControlStatus || msg.Type == wwsclient.ControlNotice {
+				log.Println(msg.Message)
+			}
+		}
+		exit(wwsclient.Pipe(ctx, NewStdioConn(), ws))
+	}
+}
+
+func forwardUDP(ws messageConn) error {
+	if *udpTimeout <= 0 {
+		kingpin.Fatalf("--udp-timeout must be positive")
 	}
-	kingpin.FatalIfError(err, "Couldn't create listener")
 
-	go write(conn, ws, ready)
-	read(conn, ws)
+	if len(*udpListen) > 0 {
+		addr, err := net.ResolveUDPAddr("udp", *udpListen)
+		kingpin.FatalIfError(err, "Couldn't resolve UDP listen address")
+		log.Println("Setupping UDP listener on ", addr.String())
+		l, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			return err
+		}
+		return serveUDPListen(ws, l, *udpTimeout)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", *udpProxy)
+	kingpin.FatalIfError(err, "Couldn't resolve UDP proxy address")
+	log.Println("Setupping UDP proxy to ", addr.String())
+	return serveUDPProxy(ws, addr, *udpTimeout)
 }
 
-func connect(url string) *websocket.Conn {
+func encrypted() bool {
+	return len(*pskFile) > 0 || len(*keyFile) > 0 || len(*peerKey) > 0
+}
+
+// options turns the flags into the channel's options.
+func options() *wwsclient.Options {
+	opts := &wwsclient.Options{
+		Header:            parseHeaders(*headers),
+		Compress:          *compress,
+		CompressThreshold: *compressMin,
+		Target:            *target,
+		Next:              &wwsclient.Options{Header: parseHeaders(*proxyHeader)},
+	}
+	if !encrypted() {
+		return opts
+	}
+
+	if (len(*keyFile) > 0) != (len(*peerKey) > 0) {
+		kingpin.Fatalf("--key-file and --peer-key go together")
+	}
+
+	var err error
+	if len(*pskFile) > 0 {
+		opts.PSK, err = wwsclient.LoadPSK(*pskFile)
+		kingpin.FatalIfError(err, "Couldn't load pre-shared key")
+	}
+	if len(*keyFile) > 0 {
+		opts.Key, err = wwsclient.LoadKey(*keyFile)
+		kingpin.FatalIfError(err, "Couldn't load key")
+		log.Println("Our public key is", hex.EncodeToString(opts.Key.Public))
+		opts.PeerKey, err = wwsclient.ParsePeerKey(*peerKey)
+		kingpin.FatalIfError(err, "Invalid --peer-key")
+	}
+	return opts
+}
+
+// parseHeaders turns "Name: value" flags into a header.
+func parseHeaders(list []string) http.Header {
+	header := http.Header{}
+	for _, h := range list {
+		i := strings.IndexByte(h, ':')
+		if i <= 0 {
+			kingpin.Fatalf("invalid header %q, expected 'Name: value'", h)
+		}
+		header.Add(strings.TrimSpace(h[:i]), strings.TrimSpace(h[i+1:]))
+	}
+	return header
+}
+
+func connect(url string, opts *wwsclient.Options) *wwsclient.Conn {
 	log.Printf("connecting to %s...", url)
-	ws, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	ws, err := wwsclient.Dial(context.Background(), url, opts)
 	if err != nil {
-		log.Fatal("handshake failed with status ", resp.StatusCode)
+		log.Fatal("handshake failed: ", err)
+	}
+	if encrypted() {
+		log.Println("Channel is encrypted end-to-end")
 	}
 	log.Print("ready, exit with CTRL+C.")
 	return ws
 }
 
-func tcpConn(addr *net.TCPAddr, ready chan<- struct{}) (n net.Conn, err error) {
-	l, err := net.Listen("tcp", addr.String())
+// fileMode is the --socket-mode of unix sockets we listen to.
+func fileMode() os.FileMode {
+	if len(*socketMode) == 0 {
+		return 0
+	}
+	mode, err := strconv.ParseUint(*socketMode, 8, 32)
 	if err != nil {
-		fmt.Println("Error listening:", err.Error())
-		os.Exit(1)
+		kingpin.Fatalf("invalid --socket-mode %q", *socketMode)
 	}
-
-	n, err = l.Accept()
-	ready <- struct{}{}
-	return n, err
+	return os.FileMode(mode)
 }
 
-func trapCtrlC(ws *websocket.Conn) {
+func trapCtrlC(ws *wwsclient.Conn) {
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt)
 	go func() {
 		for range ch {
 			fmt.Println("\nexiting")
 			ws.Close()
-			os.Exit(0)
-		}
-	}()
-}
-
-// stdin/conn -> ws.
-func write(conn net.Conn, ws *websocket.Conn, ready <-chan struct{}) {
-	_ = <-ready //wait for ready signal before starting read loop
-	//below WriteMessage returns when the data has been flushed, so safe to reuse buffer
-	buf := make([]byte, 64*1024) // pipe buffer is usually 64kb
-	for {
-		n, err := conn.Read(buf)
-		if err != nil {
-			log.Fatalln(err)
-		}
-		if err := ws.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
-			log.Fatalln("Error while writing to ws:", err)
-		}
-	}
-}
-
-// ws -> stdout/conn
-func read(conn net.Conn, ws *websocket.Conn) {
-	for {
-		messageType, buf, err := ws.ReadMessage()
-		if err != nil {
-			return
-		}
-		if messageType == websocket.BinaryMessage {
-			if n, err := conn.Write(buf); err != nil || n < len(buf) {
-				log.Fatalln("Error writing to websocket from stdin:", err)
+			if listener != nil {
+				listener.Close()
 			}
+			os.Exit(exitNormal)
 		}
-	}
+	}()
 }
@@ -0,0 +1,277 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+// Package wwsclient opens wwsconnector channels from Go programs: it's what
+// wwscat is built on.
+//
+// A channel side is a *Conn, a net.Conn whose reads and writes are carried
+// in websocket messages:
+//
+//	id, err := wwsclient.CreateChannel(ctx, "https://connector.example.com", nil)
+//	conn, err := wwsclient.Dial(ctx, "wss://connector.example.com/ws/tunnel/"+id, nil)
+//
+// and the other side, on the network we can't reach, runs:
+//
+//	err := wwsclient.ServeProxy(ctx, "wss://connector.example.com/ws/proxy/"+id, "localhost:22", nil)
+//
+// When the channel closes for any other reason than a normal closure, reads
+// return a *CloseError telling why.
+package wwsclient
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/flynn/noise"
+	"github.com/gorilla/websocket"
+)
+
+// Close codes sent by wwsconnector on top of the standard ones.
+const (
+	CloseTimeout        = 4000 // the other side stopped responding
+	ClosePeerLost       = 4001 // the other side dropped without a close frame
+	CloseChannelUnknown = 4002
+	CloseAuthFailed     = 4003 // the ssh server refused our credentials
+	CloseSSHFailed      = 4004 // couldn't establish the ssh session
+	CloseAgentReplaced  = 4005 // another agent connected with the same name
+	CloseNotShared      = 4006 // the session can't be watched
+	CloseHopFailed      = 4007 // couldn't reach the next connector of a chain
+	CloseAgentTaken     = 4008 // an agent with other credentials has the name
+	CloseExitStatus     = 4100 // + the exit status (0-255) of the ssh session
+)
+
+// CloseError is why the channel was closed, as told by the connector.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if len(e.Reason) > 0 {
+		return fmt.Sprintf("channel closed: %s (%d)", e.Reason, e.Code)
+	}
+	return fmt.Sprintf("channel closed (%d)", e.Code)
+}
+
+// Temporary is true when the connector is going away: reconnecting should
+// work.
+func (e *CloseError) Temporary() bool {
+	return e.Code == websocket.CloseGoingAway
+}
+
+// StatusError is an HTTP error from the connector, creating a channel or
+// connecting to one.
+type StatusError struct {
+	Op         string
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	if len(e.Message) > 0 {
+		return fmt.Sprintf("%s: %d %s: %s", e.Op, e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+	}
+	return fmt.Sprintf("%s: %d %s", e.Op, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// Options for a channel side. The zero value (or nil) is a plain channel.
+type Options struct {
+	// Headers sent with the websocket handshake.
+	Header http.Header
+	// Ask for per-message compression, for messages of at least
+	// CompressThreshold bytes.
+	Compress          bool
+	CompressThreshold int
+	// End-to-end encryption with the other side: a pre-shared key (see
+	// LoadPSK), pinned static keys (see LoadKey and ParsePeerKey), or both.
+	PSK     []byte
+	Key     *noise.DHKey
+	PeerKey []byte
+	// Tunnel side: ask the proxy to dial this destination instead of its
+	// default one.
+	Target string
+	// Proxy side: the destinations the tunnel side may ask for.
+	Policy *Policy
+	// Proxy side: the options to dial the destination with when it's a
+	// channel on another connector (a ws:// or wss:// URL), like its own
+	// Header to authenticate to that connector.
+	Next *Options
+}
+
+func (opts *Options) encrypted() bool {
+	return len(opts.PSK) > 0 || opts.Key != nil
+}
+
+// Dial connects to a channel side, like wss://host/ws/tunnel/<id>. ctx
+// bounds the connection and the encryption handshake, then the Conn itself:
+// it's closed once ctx is done. Close the Conn to leave the channel sooner.
+func Dial(ctx context.Context, channelURL string, opts *Options) (*Conn, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if (opts.Key != nil) != (len(opts.PeerKey) > 0) {
+		return nil, fmt.Errorf("wwsclient: Key and PeerKey go together")
+	}
+
+	dialer := *websocket.DefaultDialer
+	// encrypted messages don't compress, don't bother
+	dialer.EnableCompression = opts.Compress && !opts.encrypted()
+	ws, resp, err := dialer.DialContext(ctx, channelURL, opts.Header)
+	if err == websocket.ErrBadHandshake && resp != nil {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, &StatusError{Op: "dial", StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	} else if err != nil {
+		return nil, err
+	}
+
+	var messages messageConn = ws
+	if opts.encrypted() {
+		stop := closeOnCancel(ctx, ws.Close)
+		// the side connected as the channel's proxy answers the handshake
+		initiator := !strings.Contains(channelURL, "/ws/proxy/")
+		messages, err = secureHandshake(ws, initiator, opts.PSK, opts.Key, opts.PeerKey)
+		if !stop() {
+			err = ctx.Err()
+		}
+		if err != nil {
+			ws.Close()
+			return nil, err
+		}
+	}
+	conn := newConn(messages, ws, opts)
+
+	if len(opts.Target) > 0 {
+		if err := conn.SendControl(ControlMessage{Type: ControlTarget, Target: opts.Target}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+			case <-conn.conn.Done():
+			}
+		}()
+	}
+	return conn, nil
+}
+
+// CreateOptions for CreateChannel.
+type CreateOptions struct {
+	// "tunnel" (the default) or "ssh".
+	Type string
+	// Hand the channel to the agent with this name.
+	Agent string
+	// An ssh channel the connector connects directly to this host:port.
+	Direct string
+	// Go through these other connectors, comma separated hop names known
+	// to the connector.
+	Via    string
+	Header http.Header
+	// http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// CreateChannel asks the connector at base (http, https, ws or wss URL) for
+// a new channel, and returns its ID.
+func CreateChannel(ctx context.Context, base string, opts *CreateOptions) (string, error) {
+	if opts == nil {
+		opts = &CreateOptions{}
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	u.Path = path.Join(u.Path, "/create")
+	query := url.Values{}
+	if len(opts.Type) > 0 {
+		query.Set("type", opts.Type)
+	}
+	if len(opts.Agent) > 0 {
+		query.Set("agent", opts.Agent)
+	}
+	if len(opts.Direct) > 0 {
+		query.Set("direct", opts.Direct)
+	}
+	if len(opts.Via) > 0 {
+		query.Set("via", opts.Via)
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("POST", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	for key, values := range opts.Header {
+		req.Header[key] = values
+	}
+
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", &StatusError{Op: "create", StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// ChannelURL returns the websocket URL of a channel's side ("tunnel" or
+// "proxy"), given the connector's base URL.
+func ChannelURL(base *url.URL, side, id string) *url.URL {
+	u := *base
+	u.Path = path.Join(u.Path, "/ws", side, id)
+	u.RawQuery = ""
+	return &u
+}
+
+// closeOnCancel calls closeFn if ctx is done before stop is called. stop
+// returns false if closeFn was called.
+func closeOnCancel(ctx context.Context, closeFn func() error) (stop func() bool) {
+	done := make(chan struct{})
+	result := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			closeFn()
+			result <- false
+		case <-done:
+			result <- true
+		}
+	}()
+
+	var once sync.Once
+	var ok bool
+	return func() bool {
+		once.Do(func() {
+			close(done)
+			ok = <-result
+		})
+		return ok
+	}
+}
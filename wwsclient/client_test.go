@@ -0,0 +1,188 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package wwsclient_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wegel/wwscc/connector"
+	"github.com/wegel/wwscc/wwsclient"
+)
+
+func testConnector(t *testing.T, opts *connector.Options) (base, wsBase string) {
+	t.Helper()
+	hub, err := connector.NewHub(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(hub.Handler())
+	t.Cleanup(srv.Close)
+	return srv.URL, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func TestCreateChannel(t *testing.T) {
+	base, wsBase := testConnector(t, &connector.Options{})
+	ctx := context.Background()
+
+	for _, url := range []string{base, wsBase, base + "/"} {
+		if id, err := wwsclient.CreateChannel(ctx, url, nil); err != nil || len(id) != 36 {
+			t.Errorf("%s: got %q, %v", url, id, err)
+		}
+	}
+
+	_, err := wwsclient.CreateChannel(ctx, base, &wwsclient.CreateOptions{Type: "nope"})
+	if se, ok := err.(*wwsclient.StatusError); !ok || se.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown type: %v", err)
+	}
+	_, err = wwsclient.CreateChannel(ctx, base, &wwsclient.CreateOptions{Agent: "offline"})
+	if se, ok := err.(*wwsclient.StatusError); !ok || se.StatusCode != http.StatusNotFound {
+		t.Errorf("offline agent: %v", err)
+	}
+}
+
+func TestDial(t *testing.T) {
+	base, wsBase := testConnector(t, &connector.Options{})
+	ctx := context.Background()
+	id, err := wwsclient.CreateChannel(ctx, base, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunnel, err := wwsclient.Dial(ctx, wsBase+"/ws/tunnel/"+id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+	proxy, err := wwsclient.Dial(ctx, wsBase+"/ws/proxy/"+id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tunnel.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	proxy.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(proxy, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("proxy read %q, %v", buf, err)
+	}
+
+	// a normal close reads as EOF on the other side
+	proxy.Close()
+	tunnel.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := tunnel.Read(buf); err != io.EOF {
+		t.Errorf("tunnel read %v once the proxy closed, want EOF", err)
+	}
+}
+
+func TestDialErrors(t *testing.T) {
+	_, wsBase := testConnector(t, &connector.Options{
+		Authorize: func(r *http.Request, req connector.Request) error {
+			if req.Op == connector.OpProxy {
+				return errors.New("no proxies")
+			}
+			return nil
+		},
+	})
+	ctx := context.Background()
+
+	_, err := wwsclient.Dial(ctx, wsBase+"/ws/proxy/00000000-0000-0000-0000-000000000000", nil)
+	if se, ok := err.(*wwsclient.StatusError); !ok || se.StatusCode != http.StatusForbidden {
+		t.Errorf("refused: %v", err)
+	}
+
+	// closed right away, without a tar-trap
+	conn, err := wwsclient.Dial(ctx, wsBase+"/ws/tunnel/00000000-0000-0000-0000-000000000000", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if ce, ok := err.(*wwsclient.CloseError); !ok || ce.Code != wwsclient.CloseChannelUnknown {
+		t.Errorf("unknown channel: %v", err)
+	}
+}
+
+func TestDialContextCloses(t *testing.T) {
+	base, wsBase := testConnector(t, &connector.Options{})
+	id, err := wwsclient.CreateChannel(context.Background(), base, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := wwsclient.Dial(ctx, wsBase+"/ws/tunnel/"+id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		read <- err
+	}()
+
+	cancel()
+	select {
+	case err := <-read:
+		if err == nil {
+			t.Error("read succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the Conn outlived its context")
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	// answers once it read everything, like an upload
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		buf, _ := ioutil.ReadAll(c)
+		c.Write([]byte("got " + string(buf)))
+	}()
+
+	base, wsBase := testConnector(t, &connector.Options{})
+	ctx := context.Background()
+	id, err := wwsclient.CreateChannel(ctx, base, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go wwsclient.ServeProxy(ctx, wsBase+"/ws/proxy/"+id, l.Addr().String(), nil)
+	tunnel, err := wwsclient.Dial(ctx, wsBase+"/ws/tunnel/"+id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	// the eof control message goes through the channel to the target
+	tunnel.Write([]byte("upload"))
+	if err := tunnel.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	tunnel.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf, err := ioutil.ReadAll(tunnel)
+	if err != nil || string(buf) != "got upload" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+	if !tunnel.PeerEOF() {
+		t.Error("the proxy side didn't send eof")
+	}
+}
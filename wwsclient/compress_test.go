@@ -0,0 +1,209 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package wwsclient_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wegel/wwscc/connector"
+	"github.com/wegel/wwscc/wwsclient"
+)
+
+// recorded is what went through one connection to the connector.
+type recorded struct {
+	mu          sync.Mutex
+	read, wrote bytes.Buffer
+}
+
+func (r *recorded) bytes() (read, wrote []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]byte(nil), r.read.Bytes()...), append([]byte(nil), r.wrote.Bytes()...)
+}
+
+type recordedConn struct {
+	net.Conn
+	r *recorded
+}
+
+func (c recordedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.r.mu.Lock()
+	c.r.read.Write(b[:n])
+	c.r.mu.Unlock()
+	return n, err
+}
+
+func (c recordedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.r.mu.Lock()
+	c.r.wrote.Write(b[:n])
+	c.r.mu.Unlock()
+	return n, err
+}
+
+type recordingListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []*recorded
+}
+
+func (l *recordingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	r := &recorded{}
+	l.mu.Lock()
+	l.conns = append(l.conns, r)
+	l.mu.Unlock()
+	return recordedConn{c, r}, nil
+}
+
+// websocket finds the connection that asked for path.
+func (l *recordingListener) websocket(t *testing.T, path string) *recorded {
+	t.Helper()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, r := range l.conns {
+		if read, _ := r.bytes(); bytes.HasPrefix(read, []byte("GET "+path+" ")) {
+			return r
+		}
+	}
+	t.Fatalf("no connection for %s", path)
+	return nil
+}
+
+// compressed tells, for each binary data frame after the handshake, if it
+// was compressed (RSV1 set).
+func compressed(t *testing.T, stream []byte) (frames []bool) {
+	t.Helper()
+	i := bytes.Index(stream, []byte("\r\n\r\n"))
+	if i < 0 {
+		t.Fatal("no handshake")
+	}
+	for buf := stream[i+4:]; len(buf) >= 2; {
+		opcode, rsv1 := buf[0]&0x0f, buf[0]&0x40 != 0
+		length, header := uint64(buf[1]&0x7f), 2
+		switch length {
+		case 126:
+			length, header = uint64(binary.BigEndian.Uint16(buf[2:])), 4
+		case 127:
+			length, header = binary.BigEndian.Uint64(buf[2:]), 10
+		}
+		if buf[1]&0x80 != 0 {
+			header += 4 // masking key
+		}
+		if opcode == 2 {
+			frames = append(frames, rsv1)
+		}
+		buf = buf[uint64(header)+length:]
+	}
+	return frames
+}
+
+func compressTest(t *testing.T) (l *recordingListener, base, wsBase string) {
+	t.Helper()
+	hub, err := connector.NewHub(&connector.Options{Compress: true, CompressThreshold: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(hub.Handler())
+	l = &recordingListener{Listener: srv.Listener}
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return l, srv.URL, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// sendBoth dials both sides of a new channel, sends a small then a large
+// message from the tunnel side, and returns the channel ID once the proxy
+// side read them.
+func sendBoth(t *testing.T, base, wsBase string, opts *wwsclient.Options) string {
+	t.Helper()
+	ctx := context.Background()
+	id, err := wwsclient.CreateChannel(ctx, base, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// encrypted sides only connect together
+	proxies := make(chan *wwsclient.Conn, 1)
+	go func() {
+		proxy, err := wwsclient.Dial(ctx, wsBase+"/ws/proxy/"+id, opts)
+		if err != nil {
+			t.Error(err)
+		}
+		proxies <- proxy
+	}()
+	tunnel, err := wwsclient.Dial(ctx, wsBase+"/ws/tunnel/"+id, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+	proxy := <-proxies
+	if proxy == nil {
+		t.FailNow()
+	}
+	defer proxy.Close()
+
+	small, large := []byte("small"), bytes.Repeat([]byte("large "), 200)
+	tunnel.Write(small)
+	tunnel.Write(large)
+	buf := make([]byte, len(small)+len(large))
+	proxy.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(proxy, buf); err != nil || !bytes.Equal(buf, append(small, large...)) {
+		t.Fatalf("proxy read %q, %v", buf, err)
+	}
+	return id
+}
+
+func TestCompressThreshold(t *testing.T) {
+	l, base, wsBase := compressTest(t)
+	id := sendBoth(t, base, wsBase, &wwsclient.Options{Compress: true, CompressThreshold: 100})
+
+	read, _ := l.websocket(t, "/ws/tunnel/"+id).bytes()
+	if !bytes.Contains(bytes.ToLower(read), []byte("sec-websocket-extensions: permessage-deflate")) {
+		t.Error("the tunnel side didn't ask for compression")
+	}
+	// only the large message is compressed, from the tunnel side and relayed
+	if got := compressed(t, read); len(got) != 2 || got[0] || !got[1] {
+		t.Errorf("tunnel side sent compressed frames %v, want [false true]", got)
+	}
+	_, wrote := l.websocket(t, "/ws/proxy/"+id).bytes()
+	if !bytes.Contains(bytes.ToLower(wrote), []byte("sec-websocket-extensions: permessage-deflate")) {
+		t.Error("compression not negotiated with the proxy side")
+	}
+	if got := compressed(t, wrote); len(got) != 2 || got[0] || !got[1] {
+		t.Errorf("relayed compressed frames %v, want [false true]", got)
+	}
+}
+
+func TestCompressEncrypted(t *testing.T) {
+	l, base, wsBase := compressTest(t)
+	psk := bytes.Repeat([]byte{7}, 32)
+	id := sendBoth(t, base, wsBase, &wwsclient.Options{Compress: true, CompressThreshold: 100, PSK: psk})
+
+	for _, path := range []string{"/ws/tunnel/" + id, "/ws/proxy/" + id} {
+		read, wrote := l.websocket(t, path).bytes()
+		if bytes.Contains(bytes.ToLower(read), []byte("permessage-deflate")) {
+			t.Errorf("%s asked for compression with encryption on", path)
+		}
+		for _, frames := range [][]bool{compressed(t, read), compressed(t, wrote)} {
+			for _, c := range frames {
+				if c {
+					t.Errorf("%s: compressed frame with encryption on", path)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package wwsclient
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/wegel/wwscc/wsconn"
+)
+
+// messageConn is what we need from a websocket: the websocket itself, or one
+// of the wrappers adding encryption or compression.
+type messageConn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	Close() error
+}
+
+// socket adds what wsconn needs from the websocket itself to a messageConn.
+type socket struct {
+	messageConn
+	raw *websocket.Conn
+}
+
+func (s socket) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	return s.raw.WriteControl(messageType, data, deadline)
+}
+
+func (s socket) SetWriteDeadline(t time.Time) error {
+	return s.raw.SetWriteDeadline(t)
+}
+
+func (s socket) LocalAddr() net.Addr {
+	return s.raw.LocalAddr()
+}
+
+func (s socket) RemoteAddr() net.Addr {
+	return s.raw.RemoteAddr()
+}
+
+// Conn is one side of a channel. As a net.Conn, it reads and writes the
+// data carried in binary messages, and hands the control messages it reads
+// to OnControl. ReadMessage and WriteMessage give access to the messages
+// themselves, for protocols multiplexing several streams on a channel; don't
+// mix them with Read.
+type Conn struct {
+	// Called by Read for each control message, if set.
+	OnControl func(ControlMessage)
+
+	conn    *wsconn.Conn
+	next    *Options // Options.Next, for Proxy
+	peerEOF int32    // set atomically once the other side sent ControlEOF
+}
+
+// newConn builds the Conn on top of ws, raw itself or a wrapper around it.
+func newConn(ws messageConn, raw *websocket.Conn, opts *Options) *Conn {
+	if opts.Compress && !opts.encrypted() {
+		ws = &thresholdConn{Conn: raw, threshold: opts.CompressThreshold}
+	}
+	conn := &Conn{conn: wsconn.New(socket{messageConn: ws, raw: raw}), next: opts.Next}
+	conn.conn.OnText = func(buf []byte) error {
+		var msg ControlMessage
+		if err := json.Unmarshal(buf, &msg); err != nil {
+			return nil
+		}
+		if msg.Type == ControlEOF {
+			atomic.StoreInt32(&conn.peerEOF, 1)
+			return io.EOF
+		}
+		if conn.OnControl != nil {
+			conn.OnControl(msg)
+		}
+		return nil
+	}
+	return conn
+}
+
+// Read reads data sent by the other side. It returns io.EOF once the other
+// side is done writing (see PeerEOF) or the channel was closed normally, and
+// a *CloseError for any other reason.
+func (c *Conn) Read(b []byte) (n int, err error) {
+	n, err = c.conn.Read(b)
+	return n, closeError(err)
+}
+
+// ReadMessage reads the next message, data or control. The error is a
+// *CloseError once the channel is closed, whatever the reason.
+func (c *Conn) ReadMessage() (messageType int, data []byte, err error) {
+	messageType, data, err = c.conn.ReadMessage()
+	return messageType, data, closeError(err)
+}
+
+func closeError(err error) error {
+	if ce, ok := err.(*websocket.CloseError); ok {
+		return &CloseError{Code: ce.Code, Reason: ce.Text}
+	}
+	return err
+}
+
+// Write sends b to the other side, in one message.
+func (c *Conn) Write(b []byte) (n int, err error) {
+	if err = c.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// WriteMessage may be called concurrently with the other methods. After
+// CloseWrite, only control messages can be sent.
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	return c.conn.WriteMessage(messageType, data)
+}
+
+// SendControl sends a control message to the other side.
+func (c *Conn) SendControl(msg ControlMessage) error {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.conn.WriteMessage(websocket.TextMessage, buf)
+}
+
+// CloseWrite tells the other side we're done writing, like shutting down
+// the write side of a TCP connection: its Read returns io.EOF after what we
+// wrote before, and the channel stays open for what it still has to send
+// us. Close the channel once both sides are done.
+func (c *Conn) CloseWrite() error {
+	return c.conn.CloseWrite()
+}
+
+// PeerEOF tells if the other side is done writing (it called CloseWrite),
+// as opposed to having closed the channel.
+func (c *Conn) PeerEOF() bool {
+	return atomic.LoadInt32(&c.peerEOF) != 0
+}
+
+// Close leaves the channel, telling the other side it was closed normally.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// closeWith closes the channel passing on why another one closed, for a
+// chain of connectors. The codes meaning there was no close frame can't be
+// sent, the other side lost that channel.
+func (c *Conn) closeWith(ce *CloseError) error {
+	code, reason := ce.Code, ce.Reason
+	switch code {
+	case websocket.CloseNoStatusReceived, websocket.CloseAbnormalClosure, websocket.CloseTLSHandshake:
+		code, reason = ClosePeerLost, "peer connection lost"
+	}
+	// a close frame payload holds 123 bytes of reason
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	return c.conn.CloseWith(code, reason)
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// thresholdConn only compresses messages of at least threshold bytes: small
+// interactive messages aren't worth the latency. Compression only happens if
+// the server agreed to it during the handshake.
+type thresholdConn struct {
+	*websocket.Conn
+	threshold int
+}
+
+func (conn *thresholdConn) WriteMessage(messageType int, data []byte) error {
+	conn.EnableWriteCompression(len(data) >= conn.threshold)
+	return conn.Conn.WriteMessage(messageType, data)
+}
@@ -0,0 +1,35 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package wwsclient
+
+// Control messages are sent as websocket text frames; data is always sent
+// in binary frames, so the two never mix.
+type ControlMessage struct {
+	Type    string `json:"type"`
+	Target  string `json:"target,omitempty"`
+	ID      uint32 `json:"id,omitempty"`
+	Channel string `json:"channel,omitempty"`
+	Message string `json:"message,omitempty"`
+	Count   int    `json:"count,omitempty"`
+}
+
+const (
+	// Sent by the tunnel side to pick the destination the proxy dials.
+	ControlTarget = "target"
+	// Open and close a reverse forwarded stream.
+	ControlOpen  = "open"
+	ControlClose = "close"
+	// Acknowledges Count data frames of a reverse forwarded stream, written
+	// to its conn: the sender only has so many in flight.
+	ControlAck = "ack"
+	// Sent by the connector to an agent, to have it proxy a channel.
+	ControlAttach = "attach"
+	// The sender is done writing, like a TCP FIN; it keeps reading.
+	ControlEOF = "eof"
+	// Sent by the connector to the tunnel side of an ssh channel while it
+	// sets up the session.
+	ControlStatus = "status"
+	// Sent by the connector when someone joins or leaves a shared ssh
+	// session.
+	ControlNotice = "notice"
+)
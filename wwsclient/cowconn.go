@@ -0,0 +1,155 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package wwsclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// 'Connect on Write' net.Conn wrapper
+// The destination is either the fixed remote given at creation, or one
+// requested by the tunnel side (see setTarget) and checked against policy.
+// The remote may also be a channel on another connector, dialed with next.
+// ready is signaled once connected (or once we know we never will), there is
+// nothing to read before that.
+type cowConn struct {
+	ctx       context.Context
+	ready     chan struct{}
+	tcp       net.Conn
+	network   string
+	address   string
+	policy    *Policy
+	next      *Options
+	err       error
+	hopFailed bool // the next connector couldn't be reached
+	connected bool
+	eof       bool // CloseWrite before connecting: there's nothing to read
+}
+
+func newCOWConn(ctx context.Context, remote string, policy *Policy, next *Options) (conn *cowConn, err error) {
+	conn = &cowConn{ctx: ctx, ready: make(chan struct{}, 1), policy: policy, next: next, connected: false}
+	if len(remote) == 0 {
+		return conn, nil
+	}
+
+	conn.network, conn.address = SplitAddr(remote)
+	if conn.network == "tcp" {
+		if _, err = net.ResolveTCPAddr("tcp", conn.address); err != nil {
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// setTarget selects the destination requested by the tunnel side. It must be
+// called before the first Write. A refused target is remembered so that we
+// never silently fall back to the default destination.
+func (conn *cowConn) setTarget(target string) error {
+	if conn.connected {
+		conn.err = fmt.Errorf("cowConn: setTarget: already connected to %s", conn.address)
+	} else if conn.policy == nil {
+		conn.err = fmt.Errorf("cowConn: setTarget: destination %s refused, there is no destination policy", target)
+	} else {
+		var network, address string
+		if network, address, conn.err = conn.policy.Resolve(target); conn.err == nil {
+			conn.network, conn.address = network, address
+		}
+	}
+	return conn.err
+}
+
+func (conn *cowConn) Read(b []byte) (n int, err error) {
+	if conn.eof {
+		return 0, io.EOF
+	}
+	if conn.tcp == nil || conn.connected == false {
+		return 0, fmt.Errorf("cowConn: Read: tcp not connected yet")
+	}
+	return conn.tcp.Read(b)
+}
+
+func (conn *cowConn) Write(b []byte) (n int, err error) {
+	if conn.err != nil {
+		return 0, conn.err
+	}
+	if !conn.connected {
+		if len(conn.address) == 0 {
+			return 0, fmt.Errorf("cowConn: Write: no target requested and no default destination")
+		}
+		if conn.network == "ws" {
+			conn.tcp, err = Dial(conn.ctx, conn.address, conn.next)
+			conn.hopFailed = err != nil
+		} else {
+			var dialer net.Dialer
+			conn.tcp, err = dialer.DialContext(conn.ctx, conn.network, conn.address)
+		}
+		if err != nil {
+			conn.err = err
+			return 0, err
+		}
+		conn.connected = true
+		conn.ready <- struct{}{}
+	}
+
+	return conn.tcp.Write(b)
+}
+
+// CloseWrite shuts down the write side of the destination. If the tunnel
+// side never sent anything, we never connect: Read returns io.EOF.
+func (conn *cowConn) CloseWrite() error {
+	if !conn.connected {
+		conn.eof = true
+		conn.ready <- struct{}{}
+		return nil
+	}
+	if cw, ok := conn.tcp.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (conn *cowConn) Close() error {
+	if conn.tcp == nil || conn.connected == false {
+		return nil
+	}
+	return conn.tcp.Close()
+}
+
+func (conn *cowConn) LocalAddr() net.Addr {
+	if conn.tcp == nil {
+		return nil
+	}
+	return conn.tcp.LocalAddr()
+}
+
+func (conn *cowConn) RemoteAddr() net.Addr {
+	if conn.tcp == nil {
+		return nil
+	}
+	return conn.tcp.RemoteAddr()
+}
+
+func (conn *cowConn) SetDeadline(t time.Time) (err error) {
+	if conn.tcp == nil || conn.connected == false {
+		return fmt.Errorf("cowConn: SetDeadline: tcp not connected yet")
+	}
+	return conn.tcp.SetDeadline(t)
+}
+
+func (conn *cowConn) SetReadDeadline(t time.Time) error {
+	if conn.tcp == nil || conn.connected == false {
+		return fmt.Errorf("cowConn: SetReadDeadline: tcp not connected yet")
+	}
+	return conn.tcp.SetReadDeadline(t)
+}
+
+func (conn *cowConn) SetWriteDeadline(t time.Time) error {
+	if conn.tcp == nil || conn.connected == false {
+		return fmt.Errorf("cowConn: SetWriteDeadline: tcp not connected yet")
+	}
+	return conn.tcp.SetWriteDeadline(t)
+}
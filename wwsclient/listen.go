@@ -0,0 +1,110 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package wwsclient
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// SplitAddr turns "unix:/path/to/sock" into ("unix", "/path/to/sock"), and
+// a ws:// or wss:// URL of a channel into ("ws", URL); anything else is a
+// TCP host:port.
+func SplitAddr(addr string) (network, address string) {
+	if strings.HasPrefix(addr, "unix:") {
+		return "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	if strings.HasPrefix(addr, "ws://") || strings.HasPrefix(addr, "wss://") {
+		return "ws", addr
+	}
+	return "tcp", addr
+}
+
+// Listen listens to addr, a TCP host:port or unix:/path. A unix socket left
+// behind by a previous run is replaced, and gets mode unless it's 0: it's
+// created in a private directory and only moved into place once it has its
+// mode, so that no one can connect to it before. Closing the listener
+// removes the socket.
+func Listen(addr string, mode os.FileMode) (net.Listener, error) {
+	network, address := SplitAddr(addr)
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+	removeStaleSocket(address)
+
+	dir, err := ioutil.TempDir(filepath.Dir(address), ".wwscat")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(dir)
+	tmp := filepath.Join(dir, "sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// we remove it ourselves, once renamed
+	l.SetUnlinkOnClose(false)
+
+	if mode != 0 {
+		err = os.Chmod(tmp, mode)
+	}
+	if err == nil {
+		// unlike a rename, fails if someone is listening there already
+		err = os.Link(tmp, address)
+	}
+	os.Remove(tmp)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: l, path: address}, nil
+}
+
+type unixListener struct {
+	*net.UnixListener
+	path   string
+	remove sync.Once
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	l.remove.Do(func() {
+		os.Remove(l.path)
+	})
+	return err
+}
+
+// ServeListener waits for a single connection on l, closes l, and pipes the
+// connection through the channel.
+func ServeListener(ctx context.Context, l net.Listener, c *Conn) error {
+	stop := closeOnCancel(ctx, l.Close)
+	local, err := l.Accept()
+	l.Close()
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		c.Close()
+		return err
+	}
+	return Pipe(ctx, local, c)
+}
+
+// removeStaleSocket removes a socket left behind by a previous run, so that
+// we can listen again. Anything that isn't a socket, or a socket someone is
+// still listening on, is left alone.
+func removeStaleSocket(path string) {
+	if fi, err := os.Lstat(path); err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return
+	}
+	os.Remove(path)
+}
@@ -0,0 +1,75 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package wwsclient
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnixMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wwsclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "s.sock")
+
+	l, err := Listen("unix:"+path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want a socket with 0600", fi.Mode())
+	}
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	l.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket left behind after Close: %v", err)
+	}
+	// nor the private directory it was created in
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("%d files left in %s", len(entries), dir)
+	}
+}
+
+func TestListenReplacesStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wwsclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "s.sock")
+
+	// a socket no one listens on anymore
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := Listen("unix:"+path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// a live one is left alone
+	if _, err := Listen("unix:"+path, 0); err == nil {
+		t.Error("listened over a socket in use")
+	}
+}
@@ -0,0 +1,147 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package wwsclient
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+)
+
+// Pipe copies data both ways between local and the channel, until both
+// directions are done or ctx is done, then closes both. Each direction ends
+// on its own: when local is read entirely, the other side is told with
+// CloseWrite, and when the other side did the same, local's write side is
+// shut down if it has one (like a TCP connection). It returns nil when both
+// directions ended normally, or the other side closed the channel normally,
+// and why the channel closed otherwise.
+func Pipe(ctx context.Context, local io.ReadWriteCloser, c *Conn) error {
+	return pipe(ctx, local, c, nil)
+}
+
+// ServeProxy connects to a channel as its proxy side (a /ws/proxy/ URL),
+// and serves it like Proxy.
+func ServeProxy(ctx context.Context, channelURL string, target string, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	c, err := Dial(ctx, channelURL, opts)
+	if err != nil {
+		return err
+	}
+	return Proxy(ctx, c, target, opts.Policy)
+}
+
+// Proxy pipes the channel to target ("host:port" or "unix:/path"), dialed
+// once the tunnel side sent something. With a policy, the tunnel side may
+// ask for another destination allowed by it; target may then be empty.
+//
+// target may also be the tunnel side of a channel on another connector
+// (ws:// or wss://), dialed with the Options.Next c was dialed with, to
+// chain connectors. Why that channel closes is passed on to c.
+func Proxy(ctx context.Context, c *Conn, target string, policy *Policy) error {
+	cow, err := newCOWConn(ctx, target, policy, c.next)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	c.OnControl = func(msg ControlMessage) {
+		if msg.Type == ControlTarget {
+			cow.setTarget(msg.Target)
+		}
+	}
+	err = pipe(ctx, cow, c, cow.ready)
+	if cow.hopFailed {
+		// rather than leaving the tunnel side with a lost peer
+		c.closeWith(&CloseError{Code: CloseHopFailed, Reason: "couldn't reach the next connector: " + cow.err.Error()})
+	}
+	return err
+}
+
+// pipe only starts reading local once ready is signaled, if not nil.
+func pipe(ctx context.Context, local io.ReadWriteCloser, c *Conn, ready <-chan struct{}) error {
+	stop := closeOnCancel(ctx, c.Close)
+	defer stop()
+	defer local.Close()
+	finished := make(chan struct{})
+	defer close(finished)
+
+	var localErr error
+	var localEOF bool
+	localDone := make(chan struct{})
+	go func() {
+		defer close(localDone)
+		if ready != nil {
+			select {
+			case <-ready:
+			case <-finished:
+				return
+			}
+		}
+
+		//Write returns when the data has been flushed, so safe to reuse buffer
+		buf := make([]byte, 64*1024) // pipe buffer is usually 64kb
+		for {
+			n, err := local.Read(buf)
+			if n > 0 {
+				if _, err := c.Write(buf[:n]); err != nil {
+					// reading the channel will tell why
+					return
+				}
+			}
+			if err == io.EOF {
+				// the other side may still have data for us
+				localEOF = c.CloseWrite() == nil
+				return
+			} else if err != nil {
+				localErr = err
+				if ce, ok := err.(*CloseError); ok {
+					// local is a channel too, see Proxy
+					c.closeWith(ce)
+				} else {
+					c.Close()
+				}
+				return
+			}
+		}
+	}()
+
+	_, err := io.Copy(local, c)
+	if err == nil && c.PeerEOF() {
+		closeWrite(local)
+		// wait for our side to be done too, while watching the channel
+		readDone := make(chan error, 1)
+		go func() {
+			_, err := io.Copy(ioutil.Discard, c)
+			readDone <- err
+		}()
+		select {
+		case <-localDone:
+			if localEOF {
+				c.Close()
+				return nil
+			}
+			err = <-readDone
+		case err = <-readDone:
+		}
+	}
+
+	select {
+	case <-localDone:
+		if localErr != nil {
+			return localErr
+		}
+	default:
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// closeWrite shuts down the write side of conn, when it has one.
+func closeWrite(conn io.Writer) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
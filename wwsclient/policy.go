@@ -0,0 +1,138 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package wwsclient
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Policy is the list of destinations the tunnel side is allowed to ask the
+// proxy to connect to.
+//
+// The policy file holds one rule per line, '#' starts a comment:
+//
+//	db.internal:5432       a host name and port
+//	10.0.0.22:*            an address, any port
+//	10.1.0.0/16:22         a CIDR and port
+//	[fd00::/8]:443         IPv6 CIDRs are bracketed when a port is given
+//	192.168.0.0/24         no port means any port
+//	unix:/run/docker.sock  a unix socket, matched exactly
+type Policy struct {
+	rules []rule
+}
+
+type rule struct {
+	path string     // unix socket path, set only for unix: rules
+	host string     // lowercased host name, empty if the rule is an address
+	net  *net.IPNet // address or CIDR, nil if the rule is a host name
+	port int        // 0 means any port
+}
+
+func LoadPolicy(path string) (policy *Policy, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	policy = &Policy{}
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		r, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+		policy.rules = append(policy.rules, r)
+	}
+	return policy, scanner.Err()
+}
+
+func parseRule(s string) (r rule, err error) {
+	if network, path := SplitAddr(s); network == "unix" {
+		r.path = path
+		return r, nil
+	}
+
+	host, port := s, "*"
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		host, port = h, p
+	}
+
+	if port != "*" {
+		if r.port, err = strconv.Atoi(port); err != nil || r.port <= 0 || r.port > 65535 {
+			return r, fmt.Errorf("invalid port %q", port)
+		}
+	}
+
+	if strings.Contains(host, "/") {
+		if _, r.net, err = net.ParseCIDR(host); err != nil {
+			return r, fmt.Errorf("invalid CIDR %q", host)
+		}
+	} else if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * net.IPv4len
+		if ip.To4() == nil {
+			bits = 8 * net.IPv6len
+		}
+		r.net = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else if len(host) > 0 {
+		r.host = strings.ToLower(host)
+	} else {
+		return r, fmt.Errorf("missing host in %q", s)
+	}
+	return r, nil
+}
+
+// Resolve checks target ("host:port" or "unix:/path") against the policy and
+// returns the network and address to dial. Host names are resolved once here
+// and the resulting address is what gets dialed, so a CIDR rule can't be
+// bypassed by a name that resolves differently later on.
+func (policy *Policy) Resolve(target string) (network, address string, err error) {
+	if network, path := SplitAddr(target); network == "unix" {
+		for _, r := range policy.rules {
+			if len(r.path) > 0 && r.path == path {
+				return network, path, nil
+			}
+		}
+		return "", "", fmt.Errorf("destination %s not allowed by policy", target)
+	}
+
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", "", err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", "", fmt.Errorf("invalid port %q", portStr)
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, r := range policy.rules {
+		if r.port != 0 && r.port != port {
+			continue
+		}
+		for _, ip := range ips {
+			if (len(r.host) > 0 && r.host == strings.ToLower(host)) || (r.net != nil && r.net.Contains(ip)) {
+				return "tcp", net.JoinHostPort(ip.String(), portStr), nil
+			}
+		}
+	}
+	return "", "", fmt.Errorf("destination %s not allowed by policy", target)
+}
@@ -0,0 +1,110 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package wwsclient
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testPolicy(t *testing.T, content string) *Policy {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "wwsclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "policy")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := LoadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
+
+func TestPolicyResolve(t *testing.T) {
+	policy := testPolicy(t, `
+# comments and blank lines are skipped
+
+LocalHost:5432         # host names match in any case
+10.0.0.22:*
+10.1.0.0/16:22
+[fd00::/8]:443
+192.168.0.0/24
+unix:/run/docker.sock
+`)
+
+	for _, test := range []struct {
+		target  string
+		network string // empty if refused
+		address string // empty to not check it, host names resolve to either family
+	}{
+		{"localhost:5432", "tcp", ""},
+		{"localhost:5433", "", ""},
+		{"10.0.0.22:1", "tcp", "10.0.0.22:1"},
+		{"10.0.0.22:65535", "tcp", "10.0.0.22:65535"},
+		{"10.0.0.23:22", "", ""},
+		{"10.1.200.3:22", "tcp", "10.1.200.3:22"},
+		{"10.1.200.3:2222", "", ""},
+		{"10.2.0.1:22", "", ""},
+		{"[fd00::1]:443", "tcp", "[fd00::1]:443"},
+		{"[fd00::1]:80", "", ""},
+		{"[fe80::1]:443", "", ""},
+		{"192.168.0.9:8080", "tcp", "192.168.0.9:8080"},
+		{"192.168.1.9:8080", "", ""},
+		{"unix:/run/docker.sock", "unix", "/run/docker.sock"},
+		{"unix:/run/docker", "", ""},
+		{"unix:/run/docker.sock.bak", "", ""},
+		{"unix:/run", "", ""},
+		{"10.0.0.22", "", ""},
+		{"10.0.0.22:0", "", ""},
+		{"10.0.0.22:http", "", ""},
+	} {
+		network, address, err := policy.Resolve(test.target)
+		if test.network == "" {
+			if err == nil {
+				t.Errorf("%s: allowed as %s %s", test.target, network, address)
+			}
+			continue
+		}
+		if err != nil || network != test.network || test.address != "" && address != test.address {
+			t.Errorf("%s: got %s %s, %v, want %s %s", test.target, network, address, err, test.network, test.address)
+		}
+	}
+}
+
+func TestParseRuleInvalid(t *testing.T) {
+	for _, line := range []string{
+		":22",
+		"host:0",
+		"host:65536",
+		"host:ssh",
+		"10.0.0.0/33:22",
+		"10.0.0.0/8/8",
+		"[fd00::/129]:443",
+	} {
+		if r, err := parseRule(line); err == nil {
+			t.Errorf("%q parsed as %+v", line, r)
+		}
+	}
+}
+
+func TestLoadPolicyError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wwsclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "policy")
+	ioutil.WriteFile(path, []byte("10.0.0.1:22\n\nhost:x\n"), 0600)
+
+	_, err = LoadPolicy(path)
+	if err == nil || err.Error() != path+`:3: invalid port "x"` {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,264 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package wwsclient
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/flynn/noise"
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/curve25519"
+)
+
+// End-to-end encryption between the two client ends of a tunnel channel, so
+// that the connector only ever relays ciphertext. The peers run a Noise
+// handshake keyed by a pre-shared secret (NNpsk0), by pinned static keys (KK),
+// or both (KKpsk0). Once it completes, every websocket message is encrypted
+// and authenticated, control messages included.
+//
+// This doesn't work with ssh channels: there the connector itself has to
+// speak ssh with the proxy.
+
+var prologue = []byte("wwscc e2e v2")
+
+var cipherSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+
+// Most plaintext a single Noise message can carry.
+const maxNoisePlaintext = noise.MaxMsgLen - 16
+
+// Each chunk of a message starts with one of these, encrypted along with it,
+// so that a message cut short at a chunk boundary doesn't go unnoticed.
+const (
+	moreChunks byte = iota
+	finalChunk
+)
+
+type secureConn struct {
+	ws   *websocket.Conn
+	wmu  sync.Mutex // the send nonce has to follow the order messages are written in
+	send *noise.CipherState
+	recv *noise.CipherState
+}
+
+// secureHandshake runs the handshake over ws and returns the encrypted
+// connection. The proxy side of the channel is the responder.
+func secureHandshake(ws *websocket.Conn, initiator bool, psk []byte, key *noise.DHKey, peerKey []byte) (*secureConn, error) {
+	config := noise.Config{
+		CipherSuite: cipherSuite,
+		Pattern:     noise.HandshakeNN,
+		Initiator:   initiator,
+		Prologue:    prologue,
+	}
+	if key != nil {
+		config.Pattern = noise.HandshakeKK
+		config.StaticKeypair = *key
+		config.PeerStatic = peerKey
+	}
+	if psk != nil {
+		config.PresharedKey = psk
+		config.PresharedKeyPlacement = 0
+	}
+
+	hs, err := noise.NewHandshakeState(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// both patterns are a single round trip
+	var cs1, cs2 *noise.CipherState
+	if initiator {
+		if _, _, err = writeHandshake(ws, hs); err == nil {
+			cs1, cs2, err = readHandshake(ws, hs)
+		}
+	} else {
+		if _, _, err = readHandshake(ws, hs); err == nil {
+			cs1, cs2, err = writeHandshake(ws, hs)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("e2e handshake failed: %v", err)
+	}
+
+	// cs1 encrypts from initiator to responder, cs2 the other way around
+	if initiator {
+		return &secureConn{ws: ws, send: cs1, recv: cs2}, nil
+	}
+	return &secureConn{ws: ws, send: cs2, recv: cs1}, nil
+}
+
+func writeHandshake(ws *websocket.Conn, hs *noise.HandshakeState) (*noise.CipherState, *noise.CipherState, error) {
+	msg, cs1, cs2, err := hs.WriteMessage(nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cs1, cs2, ws.WriteMessage(websocket.BinaryMessage, msg)
+}
+
+func readHandshake(ws *websocket.Conn, hs *noise.HandshakeState) (*noise.CipherState, *noise.CipherState, error) {
+	messageType, msg, err := ws.ReadMessage()
+	if err != nil {
+		return nil, nil, err
+	}
+	if messageType != websocket.BinaryMessage {
+		return nil, nil, fmt.Errorf("unexpected message type %d", messageType)
+	}
+	_, cs1, cs2, err := hs.ReadMessage(nil, msg)
+	return cs1, cs2, err
+}
+
+// WriteMessage encrypts the message type and data. Messages too large for a
+// single Noise message are sealed in several chunks, sent as one websocket
+// message. Close frames are for the connector and are sent as-is.
+func (conn *secureConn) WriteMessage(messageType int, data []byte) error {
+	if messageType == websocket.CloseMessage {
+		return conn.ws.WriteMessage(messageType, data)
+	}
+
+	conn.wmu.Lock()
+	defer conn.wmu.Unlock()
+	ciphertext, err := seal(conn.send, messageType, data)
+	if err != nil {
+		return err
+	}
+	return conn.ws.WriteMessage(websocket.BinaryMessage, ciphertext)
+}
+
+// ReadMessage only accepts encrypted messages: anything else was not sent by
+// our peer, and is dropped.
+func (conn *secureConn) ReadMessage() (messageType int, data []byte, err error) {
+	for {
+		var ciphertext []byte
+		messageType, ciphertext, err = conn.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if messageType != websocket.BinaryMessage {
+			log.Println("Dropping unencrypted message from the connector")
+			continue
+		}
+		return open(conn.recv, ciphertext)
+	}
+}
+
+// seal encrypts a message in as many chunks as it takes, the last one
+// flagged as such.
+func seal(cs *noise.CipherState, messageType int, data []byte) ([]byte, error) {
+	plaintext := make([]byte, 0, len(data)+1)
+	plaintext = append(plaintext, byte(messageType))
+	plaintext = append(plaintext, data...)
+
+	var ciphertext []byte
+	chunk := make([]byte, 0, maxNoisePlaintext)
+	for {
+		n := len(plaintext)
+		if n > maxNoisePlaintext-1 {
+			n = maxNoisePlaintext - 1
+		}
+		flag := moreChunks
+		if n == len(plaintext) {
+			flag = finalChunk
+		}
+		chunk = append(append(chunk[:0], flag), plaintext[:n]...)
+
+		var err error
+		if ciphertext, err = cs.Encrypt(ciphertext, nil, chunk); err != nil {
+			return nil, err
+		}
+		plaintext = plaintext[n:]
+		if flag == finalChunk {
+			return ciphertext, nil
+		}
+	}
+}
+
+// open decrypts a message sealed by seal, refusing one that doesn't end with
+// its final chunk.
+func open(cs *noise.CipherState, ciphertext []byte) (messageType int, data []byte, err error) {
+	var plaintext, chunk []byte
+	for final := false; !final; {
+		if len(ciphertext) == 0 {
+			return 0, nil, fmt.Errorf("e2e: message cut short")
+		}
+		n := len(ciphertext)
+		if n > noise.MaxMsgLen {
+			n = noise.MaxMsgLen
+		}
+		if chunk, err = cs.Decrypt(chunk[:0], nil, ciphertext[:n]); err != nil {
+			return 0, nil, fmt.Errorf("e2e: %v", err)
+		}
+		if len(chunk) == 0 || chunk[0] > finalChunk {
+			return 0, nil, fmt.Errorf("e2e: malformed chunk")
+		}
+		final = chunk[0] == finalChunk
+		plaintext = append(plaintext, chunk[1:]...)
+		ciphertext = ciphertext[n:]
+	}
+	if len(ciphertext) > 0 {
+		return 0, nil, fmt.Errorf("e2e: data after the end of the message")
+	}
+	if len(plaintext) == 0 {
+		return 0, nil, fmt.Errorf("e2e: empty message")
+	}
+	return int(plaintext[0]), plaintext[1:], nil
+}
+
+func (conn *secureConn) Close() error {
+	return conn.ws.Close()
+}
+
+// LoadPSK derives the 32 byte pre-shared key from the contents of path.
+func LoadPSK(path string) ([]byte, error) {
+	secret, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret = []byte(strings.TrimSpace(string(secret)))
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	psk := sha256.Sum256(secret)
+	return psk[:], nil
+}
+
+// LoadKey reads our static private key (hex) from path. If path doesn't
+// exist, a new key is generated and saved there.
+func LoadKey(path string) (*noise.DHKey, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key, err := cipherSuite.GenerateKeypair(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("Generated new key in", path)
+		return &key, ioutil.WriteFile(path, []byte(hex.EncodeToString(key.Private)+"\n"), 0600)
+	} else if err != nil {
+		return nil, err
+	}
+
+	private, err := hex.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil || len(private) != curve25519.ScalarSize {
+		return nil, fmt.Errorf("%s doesn't hold a hex encoded private key", path)
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &noise.DHKey{Private: private, Public: public}, nil
+}
+
+// ParsePeerKey decodes the other side's hex encoded public key.
+func ParsePeerKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil || len(key) != curve25519.PointSize {
+		return nil, fmt.Errorf("peer key must be %d hex encoded bytes", curve25519.PointSize)
+	}
+	return key, nil
+}
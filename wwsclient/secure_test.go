@@ -0,0 +1,91 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package wwsclient
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/gorilla/websocket"
+)
+
+// testCiphers runs an NN handshake in memory, returning the initiator's
+// sending cipher and the responder's receiving one.
+func testCiphers(t *testing.T) (send, recv *noise.CipherState) {
+	t.Helper()
+	config := noise.Config{CipherSuite: cipherSuite, Pattern: noise.HandshakeNN, Prologue: prologue}
+	config.Initiator = true
+	initiator, err := noise.NewHandshakeState(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Initiator = false
+	responder, err := noise.NewHandshakeState(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, _, _, err := initiator.WriteMessage(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = responder.ReadMessage(nil, msg); err != nil {
+		t.Fatal(err)
+	}
+	msg, cs1, _, err := responder.WriteMessage(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, send, _, err = initiator.ReadMessage(nil, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return send, cs1
+}
+
+func TestSealOpen(t *testing.T) {
+	send, recv := testCiphers(t)
+	for _, size := range []int{0, 100, maxNoisePlaintext - 2, maxNoisePlaintext - 1, 3*maxNoisePlaintext + 5} {
+		data := bytes.Repeat([]byte{'x'}, size)
+		ciphertext, err := seal(send, websocket.TextMessage, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		messageType, got, err := open(recv, ciphertext)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if messageType != websocket.TextMessage || !bytes.Equal(got, data) {
+			t.Fatalf("%d bytes: got type %d and %d bytes", size, messageType, len(got))
+		}
+	}
+}
+
+func TestOpenCutShort(t *testing.T) {
+	send, recv := testCiphers(t)
+	ciphertext, err := seal(send, websocket.BinaryMessage, make([]byte, 2*maxNoisePlaintext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the connector drops the last chunk
+	if _, _, err := open(recv, ciphertext[:2*noise.MaxMsgLen]); err == nil {
+		t.Error("opened a message missing its last chunk")
+	}
+}
+
+func TestOpenTrailingData(t *testing.T) {
+	send, recv := testCiphers(t)
+	first, err := seal(send, websocket.BinaryMessage, []byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := seal(send, websocket.BinaryMessage, []byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two messages glued into one
+	if _, _, err := open(recv, append(first, second...)); err == nil {
+		t.Error("opened two messages as one")
+	}
+}
@@ -0,0 +1,57 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/wegel/wwscc/connector"
+	"gopkg.in/yaml.v2"
+)
+
+// loadAgentTokens reads the token each agent authenticates with, sent as
+// "Authorization: Bearer <token>" (wwscat --agent-token-file):
+//
+//	db-host: 0123abcd...
+//	web-1: 4567ef01...
+func loadAgentTokens(path string) (map[string]string, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens map[string]string
+	if err := yaml.UnmarshalStrict(buf, &tokens); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for name, token := range tokens {
+		if len(token) < 16 {
+			return nil, fmt.Errorf("%s: %s: the token must be at least 16 characters", path, name)
+		}
+	}
+	return tokens, nil
+}
+
+// authorizeAgents only lets in the agents presenting their token. Without
+// tokens, agents are refused.
+func authorizeAgents(tokens map[string]string) func(*http.Request, connector.Request) error {
+	return func(r *http.Request, req connector.Request) error {
+		if req.Op != connector.OpAgent {
+			return nil
+		}
+		token, ok := tokens[req.Agent]
+		if !ok {
+			return errors.New("unknown agent")
+		}
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			return errors.New("invalid agent token")
+		}
+		return nil
+	}
+}
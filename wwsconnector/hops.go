@@ -0,0 +1,59 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/wegel/wwscc/connector"
+	"gopkg.in/yaml.v2"
+)
+
+// loadHops reads the connectors channels can be chained through
+// (/create?via=name), with the headers authenticating us to each:
+//
+//	mid:
+//	  url: https://mid.example.com
+//	  header:
+//	    Authorization: Bearer 0123abcd
+func loadHops(path string) (map[string]connector.Hop, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]struct {
+		URL    string            `yaml:"url"`
+		Header map[string]string `yaml:"header"`
+	}
+	if err := yaml.UnmarshalStrict(buf, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	hops := make(map[string]connector.Hop)
+	for name, hop := range raw {
+		if len(name) == 0 || strings.ContainsAny(name, ", ") {
+			return nil, fmt.Errorf("%s: invalid hop name %q", path, name)
+		}
+		u, err := url.Parse(hop.URL)
+		if err != nil || len(u.Host) == 0 {
+			return nil, fmt.Errorf("%s: %s: invalid url %q", path, name, hop.URL)
+		}
+		switch u.Scheme {
+		case "http", "https", "ws", "wss":
+		default:
+			return nil, fmt.Errorf("%s: %s: url must be http(s) or ws(s)", path, name)
+		}
+
+		header := http.Header{}
+		for key, value := range hop.Header {
+			header.Set(key, value)
+		}
+		hops[name] = connector.Hop{URL: hop.URL, Header: header}
+	}
+	return hops, nil
+}
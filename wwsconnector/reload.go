@@ -0,0 +1,100 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/wegel/wwscc/config"
+	"github.com/wegel/wwscc/connector"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// Settings that SIGHUP reloads from the --config file. The others (listeners,
+// CORS, compression, the global rate) are only read at startup.
+var reloadable = []string{
+	"channel-rate",
+	"identity-rate",
+	"compress-threshold",
+	"drain",
+	"create-rate",
+	"upgrade-rate",
+	"ban-after",
+	"ban-time",
+	"tar-trap",
+	"tar-trap-max",
+}
+
+// settingsMu protects the reloadable flags. The hub has its own copy of
+// them, --drain is read through durationSetting.
+var settingsMu sync.RWMutex
+
+func durationSetting(value *time.Duration) time.Duration {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return *value
+}
+
+// checkSettings validates the settings once they are all known, at startup
+// and on reload. Must be called with settingsMu held, or before it is needed.
+func checkSettings() error {
+	for name, value := range map[string]int{
+		"channel-rate":       *channelRate,
+		"compress-threshold": *compressMin,
+		"create-rate":        *createRate,
+		"upgrade-rate":       *upgradeRate,
+		"ban-after":          *banAfter,
+		"tar-trap-max":       *tarTrapMax,
+		"global-rate":        *globalRate,
+		"identity-rate":      *identRate,
+		"webhook-retries":    *hookRetries,
+	} {
+		if value < 0 {
+			return fmt.Errorf("--%s can't be negative", name)
+		}
+	}
+	if *hookQueue < 1 {
+		return fmt.Errorf("--webhook-queue must be at least 1")
+	}
+	for name, value := range map[string]time.Duration{
+		"drain":    *drainTime,
+		"ban-time": *banTime,
+		"tar-trap": *tarTrap,
+	} {
+		if value < 0 {
+			return fmt.Errorf("--%s can't be negative", name)
+		}
+	}
+	return nil
+}
+
+// reloadOnSignal reloads the reloadable settings from path on every SIGHUP.
+// A file that fails to load or validate changes nothing.
+func reloadOnSignal(hub *connector.Hub, path string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		settingsMu.Lock()
+		changed, err := config.Reload(kingpin.CommandLine, path, os.Args[1:], reloadable, checkSettings)
+		settingsMu.Unlock()
+		if err != nil {
+			log.Println("Not reloading settings:", err)
+			continue
+		}
+
+		settingsMu.RLock()
+		opts := options()
+		settingsMu.RUnlock()
+		if err := hub.Reload(opts); err != nil {
+			log.Println("Not reloading settings:", err)
+			continue
+		}
+		log.Printf("Reloaded %s, changed: %v\n", path, changed)
+	}
+}
@@ -3,230 +3,145 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"strings"
-	"time"
 
-	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
-	"github.com/julienschmidt/httprouter"
-	"github.com/rs/cors"
+	"github.com/wegel/wwscc/config"
+	"github.com/wegel/wwscc/connector"
+	"github.com/wegel/wwscc/wwsclient"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
-var (                                                                                                                                                                                  
-	listenAddr = kingpin.Flag("listen", "Listen to this TCP host:port").Default(":8080").OverrideDefaultFromEnvar("WWS_CONN_LISTEN").Short('l').String()
-    corsOrigin = kingpin.Flag("cors", "List of CORS Allowed origin").Default("").OverrideDefaultFromEnvar("WWS_CONN_CORS").Short('c').String()
+var (
+	configFile  = kingpin.Flag("config", "Read settings from this YAML file, SIGHUP reloads it").Default("").OverrideDefaultFromEnvar("WWS_CONN_CONFIG").String()
+	listenAddr  = kingpin.Flag("listen", "Listen to this TCP host:port").Default(":8080").OverrideDefaultFromEnvar("WWS_CONN_LISTEN").Short('l').String()
+	corsOrigin  = kingpin.Flag("cors", "List of allowed origins for CORS and browser websockets").Default("").OverrideDefaultFromEnvar("WWS_CONN_CORS").Short('c').String()
+	adminAddr   = kingpin.Flag("admin", "Serve the admin API on this TCP host:port (disabled if empty)").Default("").OverrideDefaultFromEnvar("WWS_CONN_ADMIN").String()
+	channelRate = kingpin.Flag("channel-rate", "Max bytes/s relayed in each direction of a channel (0 for unlimited)").Default("0").OverrideDefaultFromEnvar("WWS_CONN_CHANNEL_RATE").Int()
+	compress    = kingpin.Flag("compress", "Accept per-message compression from clients that ask for it").Default("false").OverrideDefaultFromEnvar("WWS_CONN_COMPRESS").Bool()
+	compressMin = kingpin.Flag("compress-threshold", "Don't compress messages smaller than this many bytes").Default("256").OverrideDefaultFromEnvar("WWS_CONN_COMPRESS_THRESHOLD").Int()
+	drainTime   = kingpin.Flag("drain", "On SIGTERM, wait this long for active channels to end before closing them").Default("30s").OverrideDefaultFromEnvar("WWS_CONN_DRAIN").Duration()
+	createRate  = kingpin.Flag("create-rate", "Max channels created per minute by a single IP (0 for unlimited)").Default("30").OverrideDefaultFromEnvar("WWS_CONN_CREATE_RATE").Int()
+	upgradeRate = kingpin.Flag("upgrade-rate", "Max websocket connections per minute from a single IP (0 for unlimited)").Default("60").OverrideDefaultFromEnvar("WWS_CONN_UPGRADE_RATE").Int()
+	banAfter    = kingpin.Flag("ban-after", "Ban an IP after this many attempts to join unknown channels within --ban-time (0 to never ban)").Default("10").OverrideDefaultFromEnvar("WWS_CONN_BAN_AFTER").Int()
+	banTime     = kingpin.Flag("ban-time", "How long bans last").Default("10m").OverrideDefaultFromEnvar("WWS_CONN_BAN_TIME").Duration()
+	tarTrap     = kingpin.Flag("tar-trap", "Hold connections to unknown channels open this long before closing them (0 to close right away)").Default("30s").OverrideDefaultFromEnvar("WWS_CONN_TAR_TRAP").Duration()
+	trusted     = kingpin.Flag("trusted-proxy", "Comma separated IPs and CIDRs of the reverse proxies whose X-Forwarded-For or X-Real-IP tells the client IP").Default("").OverrideDefaultFromEnvar("WWS_CONN_TRUSTED_PROXY").String()
+	tarTrapMax  = kingpin.Flag("tar-trap-max", "Max connections held in the tar-trap at once, the others are closed right away").Default("100").OverrideDefaultFromEnvar("WWS_CONN_TAR_TRAP_MAX").Int()
+	webhooks    = kingpin.Flag("webhook", "Comma separated URLs to POST channel lifecycle events to").Default("").OverrideDefaultFromEnvar("WWS_CONN_WEBHOOK").String()
+	hookSecret  = kingpin.Flag("webhook-secret-file", "Sign webhook events with the secret in this file").Default("").OverrideDefaultFromEnvar("WWS_CONN_WEBHOOK_SECRET_FILE").String()
+	hookQueue   = kingpin.Flag("webhook-queue", "Max events waiting to be delivered to each webhook URL").Default("1000").OverrideDefaultFromEnvar("WWS_CONN_WEBHOOK_QUEUE").Int()
+	hookRetries = kingpin.Flag("webhook-retries", "Times a failed webhook delivery is retried").Default("5").OverrideDefaultFromEnvar("WWS_CONN_WEBHOOK_RETRIES").Int()
+	terminal    = kingpin.Flag("terminal", "Serve the web terminal under /terminal/").Default("true").OverrideDefaultFromEnvar("WWS_CONN_TERMINAL").Bool()
+	hopsFile    = kingpin.Flag("hops", "YAML file of the connectors channels can be chained through, with their headers").Default("").OverrideDefaultFromEnvar("WWS_CONN_HOPS").String()
+	sshDirect   = kingpin.Flag("ssh-direct", "Policy file of the ssh servers channels may connect to directly, without a proxy (disabled if empty)").Default("").OverrideDefaultFromEnvar("WWS_CONN_SSH_DIRECT").String()
+	agentTokens = kingpin.Flag("agent-tokens", "YAML file of the token each agent authenticates with (agents are refused if empty)").Default("").OverrideDefaultFromEnvar("WWS_CONN_AGENT_TOKENS").String()
+	identRate   = kingpin.Flag("identity-rate", "Max bytes/s relayed from a single IP, and for a single agent, across all their channels (0 for unlimited)").Default("0").OverrideDefaultFromEnvar("WWS_CONN_IDENTITY_RATE").Int()
+	globalRate  = kingpin.Flag("global-rate", "Max bytes/s relayed across all channels (0 for unlimited)").Default("0").OverrideDefaultFromEnvar("WWS_CONN_GLOBAL_RATE").Int()
 )
 
-const (
-	// Time allowed to write a message to the peer.
-	writeWait = 10 * time.Second
-
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (writeWait * 5) / 10
-)
-
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024 * 128,
-	WriteBufferSize: 1024 * 128,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
-
-type Hub struct {
-	channels       map[uuid.UUID]*Channel
-	createChannel  chan *Channel
-	registerClient chan *Client
-	disconnected   chan *Client
-}
-
-func newHub() *Hub {
-	return &Hub{
-		channels:       make(map[uuid.UUID]*Channel),
-		createChannel:  make(chan *Channel),
-		registerClient: make(chan *Client),
-		disconnected:   make(chan *Client),
+func main() {
+	if path := config.Path(os.Args[1:], "WWS_CONN_CONFIG"); len(path) > 0 {
+		kingpin.FatalIfError(config.Load(kingpin.CommandLine, path), "Couldn't load config")
 	}
-}
-
-type Channel struct {
-	proxy   *Client //the proxy is on the network that we can't reach
-	tunnel  *Client //the tunnel typically runs on our local computer
-	id      uuid.UUID
-	hub     *Hub
-	handler func(*Channel)
-}
-
-func (h *Hub) setClient(client *Client) {
-	if channel, ok := h.channels[client.channelID]; ok {
-		if client.remoteType == "tunnel" {
-			channel.tunnel = client
-		} else if client.remoteType == "proxy" {
-			channel.proxy = client
-		}
-
-		if channel.tunnel != nil && channel.proxy != nil {
-			log.Printf("Got both sides for channel ID: %v", client.channelID.String())
-			channel.tunnel.otherSide = channel.proxy
-			channel.proxy.otherSide = channel.tunnel
-			log.Println("Launching channel handler")
-			go channel.handler(channel)
-		}
-	} else {
-		log.Printf("Registering proxy failed for channel ID %v, channel ID unknown\n", client.channelID.String())
-
-		go func(client *Client) {
-			//tar trap potential attacker
-			time.Sleep(30 * time.Second)
-			client.ws.Close()
-		}(client)
+	kingpin.Parse()
+	kingpin.FatalIfError(checkSettings(), "Invalid settings")
+
+	opts := options()
+	opts.NotFound = http.FileServer(http.Dir("public"))
+	if len(*webhooks) > 0 {
+		secret, err := loadSecret(*hookSecret)
+		kingpin.FatalIfError(err, "Couldn't read webhook secret")
+		opts.Webhooks = strings.Split(*webhooks, ",")
+		opts.WebhookSecret = secret
 	}
-}
-
-func (h *Hub) handleMessages() {
-	log.Println("Waiting for messages on channels")
-	for {
-		select {
-		case channel := <-h.createChannel:
-			log.Printf("Creating new channel ID: %v", channel.id.String())
-			h.channels[channel.id] = channel
-
-		//the proxy is on the network that we can't reach
-		case client := <-h.registerClient:
-			log.Printf("Registering %s for channel ID: %v", client.remoteType, client.channelID.String())
-			h.setClient(client)
-
-		//one of the sides disconnected, destroy the channel
-		case client := <-h.disconnected:
-			if channel, ok := h.channels[client.channelID]; ok {
-				log.Printf("Destroying tunnel for channel ID: %v", channel.id.String())
-				if channel.proxy != nil {
-					if channel.proxy.ws != nil {
-						channel.proxy.ws.Close()
-					}
-					channel.proxy.otherSide = nil
-					channel.proxy = nil
-				}
-				if channel.tunnel != nil {
-					if channel.tunnel.ws != nil {
-						channel.tunnel.ws.Close()
-					}
-					channel.tunnel.otherSide = nil
-					channel.tunnel = nil
-				}
-				delete(h.channels, channel.id)
-			}
-		}
+	if len(*sshDirect) > 0 {
+		policy, err := wwsclient.LoadPolicy(*sshDirect)
+		kingpin.FatalIfError(err, "Couldn't load direct ssh policy")
+		opts.DirectSSH = policy
 	}
-}
+	if len(*hopsFile) > 0 {
+		hops, err := loadHops(*hopsFile)
+		kingpin.FatalIfError(err, "Couldn't load hops")
+		opts.Hops = hops
+	}
+	var tokens map[string]string
+	if len(*agentTokens) > 0 {
+		var err error
+		tokens, err = loadAgentTokens(*agentTokens)
+		kingpin.FatalIfError(err, "Couldn't load agent tokens")
+	}
+	opts.Authorize = authorizeAgents(tokens)
+	hub, err := connector.NewHub(opts)
+	kingpin.FatalIfError(err, "Invalid settings")
 
-func setRemote(hub *Hub, w http.ResponseWriter, r *http.Request, channelID uuid.UUID, remoteType string, params map[string][]string) {
-	ws, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Print("upgrade:", err)
-		return
+	log.Printf("Listening on %s\n", *listenAddr)
+	if len(*configFile) > 0 {
+		go reloadOnSignal(hub, *configFile)
 	}
-	defer ws.Close()
 
-	client := &Client{hub: hub, ws: ws, channelID: channelID, params: params, remoteType: remoteType}
-	hub.registerClient <- client
-	keepalive(client)
-}
+	if len(*adminAddr) > 0 {
+		log.Printf("Serving admin API on %s\n", *adminAddr)
+		go func() {
+			log.Fatal(http.ListenAndServe(*adminAddr, hub.AdminHandler()))
+		}()
+	}
 
-func keepalive(client *Client) {
-	defer func() {
-		client.hub.disconnected <- client
-		if r := recover(); r != nil {
-			log.Printf("error in keepalive for %s on %s: %v", client.remoteType, client.channelID, r)
+	server := &http.Server{Addr: *listenAddr, Handler: hub.Handler()}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
 		}
 	}()
-
-	ticker := time.NewTicker(pingPeriod)
-	for {
-		select {
-		case <-ticker.C:
-			if err := client.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
-				panic(err)
-			}
-			if err := client.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
-				panic(err)
-			}
-		}
-	}
-}
-
-func createChannel(hub *Hub, w http.ResponseWriter, r *http.Request, p httprouter.Params, channelHandler func(*Channel)) {
-	log.Printf("Creating new channel")
-	id := uuid.New()
-
-	channel := &Channel{hub: hub, id: id, handler: channelHandler}
-	channel.hub.createChannel <- channel
-
-	w.Write([]byte(id.String()))
+	shutdownOnSignal(hub, server)
 }
 
-func serveFile(hub *Hub, w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	log.Printf("Creating new channel")
-	id := uuid.New()
-
-	channel := &Channel{hub: hub, id: id}
-	channel.hub.createChannel <- channel
-
-	w.Write([]byte(id.String()))
-}
-
-func main() {
-	kingpin.Parse()
-	hub := newHub()
-
-	router := httprouter.New()
-	router.NotFound = http.FileServer(http.Dir("public"))
-
-	router.GET("/create", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		channelHandlerType := r.URL.Query().Get("type")
-		var channelHandler func(*Channel)
-		if len(channelHandlerType) == 0 || channelHandlerType == "tunnel" {
-			channelHandlerType = "tunnel"
-			channelHandler = Passthrough
-		} else if channelHandlerType == "ssh" {
-			channelHandler = sshShell
-		}
-		log.Println("Asked to create channel of type", channelHandlerType)
-		createChannel(hub, w, r, p, channelHandler)
-	})
-
-	router.GET("/ws/proxy/:id", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		id, _ := uuid.Parse(p.ByName("id"))
-		setRemote(hub, w, r, id, "proxy", r.URL.Query())
-	})
-	router.GET("/ws/tunnel/:id", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		id, _ := uuid.Parse(p.ByName("id"))
-		setRemote(hub, w, r, id, "tunnel", r.URL.Query())
-	})
-	router.GET("/health", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		w.Write([]byte("ok"))
-	})
-
-	log.Printf("Listening on %s\n", *listenAddr)
-	log.Printf("Pinging every %v seconds\n", pingPeriod)
-	go hub.handleMessages()
-
-	var handler http.Handler = router
-
-	// Add CORS support (Cross Origin Resource Sharing) if needed
+// options are the hub's options from the flags, but for the webhooks.
+func options() *connector.Options {
+	var origins, proxies []string
 	if len(*corsOrigin) > 0 {
-		c := cors.New(cors.Options{			
-			AllowedOrigins: strings.Split(*corsOrigin, ","),
-			AllowedMethods: []string{"GET"},
-			AllowCredentials: false,
-		})
+		origins = strings.Split(*corsOrigin, ",")
+	}
+	if len(*trusted) > 0 {
+		proxies = strings.Split(*trusted, ",")
+	}
+	return &connector.Options{
+		AllowedOrigins:    origins,
+		Compress:          *compress,
+		CompressThreshold: *compressMin,
+		ChannelRate:       *channelRate,
+		GlobalRate:        *globalRate,
+		IdentityRate:      *identRate,
+		CreateRate:        *createRate,
+		UpgradeRate:       *upgradeRate,
+		BanAfter:          *banAfter,
+		BanTime:           *banTime,
+		TarTrap:           *tarTrap,
+		TarTrapMax:        *tarTrapMax,
+		TrustedProxies:    proxies,
+		Terminal:          *terminal,
+		WebhookQueue:      *hookQueue,
+		WebhookRetries:    *hookRetries,
+	}
+}
 
-		// Insert the middleware
-		handler = c.Handler(router)
+// loadSecret reads the webhook secret from path, if there is one.
+func loadSecret(path string) ([]byte, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+	secret, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret = bytes.TrimSpace(secret)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
 	}
-	
-	log.Fatal(http.ListenAndServe(*listenAddr, handler))
+	return secret, nil
 }
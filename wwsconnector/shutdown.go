@@ -0,0 +1,51 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/wegel/wwscc/connector"
+)
+
+// Time allowed for the http server to shut down, websockets aside.
+const shutdownWait = 10 * time.Second
+
+// shutdownOnSignal waits for SIGTERM (or CTRL+C), then stops accepting new
+// channels, turns away clients still waiting for their other side, and gives
+// active channels up to --drain to end before closing them. A second signal
+// skips the wait.
+func shutdownOnSignal(hub *connector.Hub, server *http.Server) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, os.Interrupt)
+	sig := <-ch
+
+	drainTime := durationSetting(drainTime)
+	log.Printf("Got %v, draining for up to %v\n", sig, drainTime)
+	ctx, cancel := context.WithTimeout(context.Background(), drainTime)
+	defer cancel()
+	go func() {
+		<-ch
+		log.Println("Skipping the drain")
+		cancel()
+	}()
+
+	// websockets are hijacked connections, this doesn't wait for them. Done
+	// alongside the drain so that idle clients are turned away right away.
+	serverDone := make(chan struct{})
+	go func() {
+		serverCtx, serverCancel := context.WithTimeout(context.Background(), shutdownWait)
+		server.Shutdown(serverCtx)
+		serverCancel()
+		close(serverDone)
+	}()
+
+	hub.Shutdown(ctx)
+	<-serverDone
+}
@@ -0,0 +1,12 @@
+// Author: Simon Labrecque <simon@wegel.ca>
+
+// Package wwswebterminal holds the web terminal (terminal.html and xterm.js),
+// built into the connector so it can serve it without any other file.
+package wwswebterminal
+
+import "embed"
+
+// Files has terminal.html and the xterm directory at its root.
+//
+//go:embed terminal.html xterm
+var Files embed.FS